@@ -0,0 +1,65 @@
+// Copyright 2017-2018 Ettore Di Giacinto
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+// OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+// DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package anagent
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// AdaptiveTimer sets a recurring timer for pollers that slow down when idle.
+// The handler has to return a bool reporting whether it found work to do,
+// optionally followed by an error. Every fire without work multiplies the
+// interval by factor, up to max, while a fire with work restores it to base.
+// It returns an error if base is not positive, max is lower than base or
+// factor is not greater than 1, and panics if the handler is not a callable
+// func returning a bool.
+func (a *Anagent) AdaptiveTimer(base, max time.Duration, factor float64, handler Handler) (TimerID, error) {
+	if base <= 0 || max < base || factor <= 1 {
+		return "", fmt.Errorf("invalid adaptive interval: base %v, max %v, factor %v", base, max, factor)
+	}
+	t := reflect.TypeOf(validateAndWrapHandler(handler))
+	if t.NumOut() < 1 || t.Out(0).Kind() != reflect.Bool {
+		panic("Anagent AdaptiveTimer handler must return a bool")
+	}
+
+	timer := &Timer{time: a.now().Add(base), after: base, recurring: true}
+	timer.handler = validateAndWrapHandler(func() error {
+		vals, err := a.call(a.Injector, handler)
+		if err != nil {
+			return err
+		}
+
+		a.Lock()
+		if vals[0].Bool() {
+			timer.after = base
+		} else {
+			timer.after = time.Duration(float64(timer.after) * factor)
+			if timer.after > max {
+				timer.after = max
+			}
+		}
+		a.Unlock()
+		return handlerError(vals)
+	})
+	return a.addTimer(TimerID(""), timer)
+}
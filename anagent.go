@@ -21,8 +21,18 @@
 package anagent
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/chuckpreslar/emission"
@@ -32,6 +42,49 @@ import (
 // VERSION contains the Anagent version number
 const VERSION = "0.1"
 
+// ErrReentrant is returned by TryStep when it is called from
+// the Step already running, from a listener of an event emitted
+// by it, or from a handler
+var ErrReentrant = errors.New("Anagent Step is already running")
+
+// ErrAlreadyStarted is returned by StartErr when Start was called
+// on an agent already started, with the DoubleStartError policy
+var ErrAlreadyStarted = errors.New("Anagent is already started")
+
+// DoubleStartPolicy defines what happens when Start is called
+// on an agent that is already started.
+type DoubleStartPolicy int
+
+const (
+	// DoubleStartIgnore makes the second Start return silently
+	DoubleStartIgnore DoubleStartPolicy = iota
+	// DoubleStartPanic makes the second Start panic
+	DoubleStartPanic
+	// DoubleStartError makes the second Start return, recording
+	// ErrAlreadyStarted, which is returned by StartErr
+	DoubleStartError
+)
+
+// ErrTooManyTimers is returned by TimerErr when the timer is rejected
+// because the cap set with SetMaxTimers is reached
+var ErrTooManyTimers = errors.New("Anagent has too many timers")
+
+// TimersPolicy defines what happens when a new timer
+// would exceed the cap set with SetMaxTimers.
+type TimersPolicy int
+
+const (
+	// TimersRejectNew rejects the new timer
+	TimersRejectNew TimersPolicy = iota
+	// TimersEvictFurthest removes the timer scheduled furthest
+	// in the future to make room for the new one,
+	// or rejects the new timer if it is the furthest
+	TimersEvictFurthest
+)
+
+// tickRateWindow is the number of Steps considered by MeasuredTickRate
+const tickRateWindow = 32
+
 // Handler can be any callable function.
 // Anagent attempts to inject services into the handler's argument list,
 // and panics if an argument could not be fulfilled via dependency injection.
@@ -48,10 +101,34 @@ type TimerID string
 // should be fired, after contains the time.Duration of the
 // recurring timer.
 type Timer struct {
-	time      time.Time
-	after     time.Duration
-	handler   Handler
-	recurring bool
+	time       time.Time
+	after      time.Duration
+	handler    Handler
+	recurring  bool
+	label      string
+	concurrent bool
+	failures   int
+	fixedRate  bool
+	base       TimerID
+	waiting    bool
+	minFire    time.Duration
+	lastFire   time.Time
+	when       Handler
+	window     *activeWindow
+	paused     bool
+	lock       *sync.Mutex
+	lastErr    error
+	values     map[interface{}]interface{}
+	cron       *cronSchedule
+	then       func(TimerID)
+	runs       int
+	maxRuns    int
+	seq        uint64
+	drift      time.Duration
+	busy       time.Duration
+	completed  int
+	pausedAt   time.Time
+	running    int
 }
 
 // After receives a time.Duration as arguments, and sets the
@@ -60,40 +137,251 @@ func (t *Timer) After(ti time.Duration) {
 	t.after = ti
 }
 
+// reschedule sets the next fire time of a recurring timer.
+// Cron timers are scheduled from their cron expression, fixed rate
+// timers from their previous fire time, skipping the missed slots,
+// others from now.
+func (t *Timer) reschedule(now time.Time) {
+	if t.cron != nil {
+		t.time = t.cron.next(now)
+		return
+	}
+	if !t.fixedRate || t.after <= 0 {
+		t.time = now.Add(t.after)
+		return
+	}
+
+	next := t.time.Add(t.after)
+	if !next.After(now) {
+		missed := now.Sub(t.time) / t.after
+		next = t.time.Add((missed + 1) * t.after)
+	}
+	t.time = next
+}
+
+// following returns the fire following the one at f, as projected
+// from the timer schedule, and false if the timer doesn't recur.
+func (t *Timer) following(f time.Time) (time.Time, bool) {
+	if t.cron != nil {
+		next := t.cron.next(f)
+		return next, !next.IsZero()
+	}
+	if !t.recurring || t.after <= 0 {
+		return time.Time{}, false
+	}
+	return f.Add(t.after), true
+}
+
+// floor returns the earliest time the timer is allowed to fire,
+// according to its minimum fire interval.
+func (t *Timer) floor() time.Time {
+	if t.minFire <= 0 || t.lastFire.IsZero() {
+		return time.Time{}
+	}
+	return t.lastFire.Add(t.minFire)
+}
+
+// middleware holds a Handler of the middleware stack,
+// every is the tick interval the handler runs at, and
+// priority defines its position in the stack.
+type middleware struct {
+	name     string
+	handler  Handler
+	every    uint64
+	priority int
+}
+
+// Option is a functional option that configures an Anagent,
+// it is applied by NewWithOptions.
+type Option func(*Anagent)
+
 // Anagent represents the top level application.
 // inject.Injector methods can be invoked to map services on a global level.
+// A *log.Logger is mapped by default.
 type Anagent struct {
 	inject.Injector
 	sync.Mutex
 
-	handlers []Handler
-	timers   map[TimerID]*Timer
+	handlers           []*middleware
+	handlersCount      int32
+	tickTasks          []*tickTask
+	tickTasksCount     int32
+	middlewareDisabled bool
+	middlewarePolicy   MiddlewareErrorPolicy
+	warnDuplicates     bool
+	maxHandlers        int
+	errorHandler       func(error)
+	panicHandler       func(interface{})
+	timers             map[TimerID]*Timer
+	pendingDurations   map[TimerID]time.Duration
+	pendingCount       int32
+	maxTimers          int
+	idGenerator        func() TimerID
+	idCounter          uint64
+	timerSeq           uint64
+	readiness          func() bool
+	readinessPolicy    ReadinessPolicy
+	comparator         func(a, b TimerInfo) bool
+	stepBudget         time.Duration
+	warmUp             time.Duration
+	warmUntil          time.Time
+	timersPolicy       TimersPolicy
+	ticks              uint64
+	stepWaiters        int32
+	stepEmits          int32
+	stepAccess         sync.Mutex
+
+	ee     Emitter
+	clock  Clock
+	wake   chan struct{}
+	name   string
+	logger *log.Logger
+	log    Logger
+
+	doubleStartPolicy DoubleStartPolicy
+	startErr          error
+	flushNextOnStop   bool
+	flushOnce         bool
+	drainOnce         bool
+	stopPreventsStart bool
+	stoppedEarly      bool
+	done              chan struct{}
+	stepThrough       chan struct{}
+	paused            bool
+
+	concurrency chan struct{}
+	pool        *workerPool
 
-	ee *emission.Emitter
+	injectorAccess sync.RWMutex
+	safeInjector   int32
 
-	// Fatal         bool
+	breakerThreshold int
+	breakerErrors    int
+	failureThreshold int
+	failureEvent     interface{}
+
+	upcoming []*upcoming
+
+	jumpPolicy    ClockJumpPolicy
+	jumpThreshold time.Duration
+	lastWall      time.Time
+	lastMono      time.Time
+
+	statsAccess sync.Mutex
+	profiling   bool
+	profile     map[string]time.Duration
+
+	eventStatsEnabled bool
+	eventStats        map[string]*EventStat
+	steps             [tickRateWindow]time.Time
+	stepsCount        int
+
+	startupErr       error
+	fatalErr         error
+	startPanicPolicy HookPanicPolicy
+	stopPanicPolicy  HookPanicPolicy
+	startupTasks     []startupTask
+	onStart          []Handler
+	onStop           []Handler
+	deadline         time.Time
+	deadlineTimer    *time.Timer
+
+	subsAccess  sync.Mutex
+	subs        map[interface{}][]*subscription
+	prioritized map[interface{}][]*Listener
+	listenerSeq uint64
+	topics      map[string][]*Listener
+	balanced    map[interface{}]*balanced
+	bridges     map[interface{}]func(...interface{})
+	unhandled   func(event interface{})
+	transforms  map[interface{}][]func([]interface{}) []interface{}
+	timeout     time.Duration
+
+	stopsAccess sync.Mutex
+	stops       map[uint64]*stopOnError
+	stopsCount  int32
+
+	recordAccess sync.Mutex
+	recorder     *json.Encoder
+
+	handling     goroutineSet
+	stepping     goroutineSet
+	syncEmitting goroutineSet
+
+	goroutinesAccess sync.Mutex
+	goroutinesDone   *sync.Cond
+	goroutines       int
+
+	flightsAccess sync.Mutex
+	flights       map[string]*flight
+
+	stream       chan AgentEvent
+	streamAccess sync.Mutex
+	dropped      uint64
+
+	// Fatal makes errors returned by startup tasks abort the startup,
+	// and errors returned by middlewares and timer handlers stop the loop
+	Fatal         bool
 	Started       bool
 	BusyLoop      bool
 	StartedAccess *sync.Mutex
+
+	// DedupeTimers makes Timer() return the TimerID of an existing
+	// recurring timer with the same handler and interval,
+	// instead of creating a duplicate. Handlers are compared by
+	// function pointer, thus closures created by the same
+	// function literal are considered the same handler.
+	DedupeTimers bool
+
+	// Concurrent makes every timer handler run in its own goroutine,
+	// as with SetConcurrent, so a slow handler doesn't delay the other
+	// timers. Rescheduling still happens on the loop goroutine, keeping
+	// the timers mutations serialized, and the services are resolved as
+	// with SetSafeInjector, so Map can be called while handlers run.
+	Concurrent bool
+
+	// RecoverPanics makes the panics of middleware and timer handlers
+	// recovered and routed as errors to the OnError function,
+	// so the loop keeps running. Recurring timers are rescheduled as usual.
+	RecoverPanics bool
 }
 
-// On Binds a callback to an event, mapping the arguments on a global level
-func (a *Anagent) On(event, listener interface{}) *Anagent {
-	a.Emitter().On(event, func() { a.Invoke(listener) })
+// On Binds a callback to an event, mapping the arguments on a global level.
+// The arguments of the emitted event are mapped for the listener only.
+// An optional topic can be supplied, so the listener can be removed
+// with UnsubscribeTopic: such listeners are dispatched like the ones
+// bound with OnPriority, with priority 0.
+func (a *Anagent) On(event, listener interface{}, topic ...string) *Anagent {
+	if len(topic) > 0 {
+		a.bindTopic(topic[0], event, listener, false)
+		return a
+	}
+	a.EventEmitter().On(event, a.wrapListener(event, listener))
 	return a
 }
 
 // Emit Emits an event, it does accept only the event as argument, since
 // the callback will have access to the service mapped by the injector
 func (a *Anagent) Emit(event interface{}) *Anagent {
-	a.Emitter().Emit(event)
+	a.countEvent(event, 1, 0)
+	a.record(Operation{Op: OpEmit, Event: fmt.Sprint(event)})
+	if !a.handled(event) {
+		return a
+	}
+	a.emit(event)
 	return a
 }
 
 // Once Binds a callback to an event, mapping the arguments on a global level
 // It is fired only once.
-func (a *Anagent) Once(event, listener interface{}) *Anagent {
-	a.Emitter().Once(event, func() { a.Invoke(listener) })
+// The arguments of the emitted event are mapped for the listener only.
+// An optional topic can be supplied, as with On.
+func (a *Anagent) Once(event, listener interface{}, topic ...string) *Anagent {
+	if len(topic) > 0 {
+		a.bindTopic(topic[0], event, listener, true)
+		return a
+	}
+	a.EventEmitter().Once(event, a.wrapListener(event, listener))
 	return a
 }
 
@@ -101,15 +389,67 @@ func (a *Anagent) Once(event, listener interface{}) *Anagent {
 // it does accept only the event as argument, since
 // the callback will have access to the service mapped by the injector
 func (a *Anagent) EmitSync(event interface{}) *Anagent {
-	a.Emitter().EmitSync(event)
+	a.countEvent(event, 1, 0)
+	a.record(Operation{Op: OpEmit, Event: fmt.Sprint(event)})
+	if !a.handled(event) {
+		return a
+	}
+	a.runStopOnError(nil, func() {
+		a.runSyncEmit(func() { a.EventEmitter().EmitSync(event) })
+	})
 	return a
 }
 
+// EmitAfter Emits an event with the given arguments after the supplied duration,
+// by setting a non recurring timer. It returns the TimerID of the timer,
+// so the emission can be cancelled with RemoveTimer before it happens.
+func (a *Anagent) EmitAfter(d time.Duration, event interface{}, args ...interface{}) TimerID {
+	payload := make([]interface{}, len(args))
+	copy(payload, args)
+
+	return a.Timer(TimerID(""), a.now().Add(d), d, false, func() {
+		a.countEvent(event, 1, 0)
+		a.emit(event, payload...)
+	})
+}
+
+// EmitEveryFunc Emits an event every d, by setting a recurring timer.
+// The arguments of each emission are computed by the payload function
+// when the timer fires, so they are never stale.
+// It returns the TimerID of the timer, so the emissions can be stopped with RemoveTimer.
+func (a *Anagent) EmitEveryFunc(d time.Duration, event interface{}, payload func() []interface{}) TimerID {
+	return a.Timer(TimerID(""), a.now().Add(d), d, true, func() {
+		args := payload()
+		a.countEvent(event, 1, 0)
+		a.emit(event, args...)
+	})
+}
+
+// InvokeIsolated invokes the handler against a child injector of the agent,
+// where the given values are mapped. The handler can access both the
+// values and the services mapped in the agent, while the values don't
+// leak in the agent injector. Values implementing error are mapped also as error.
+func (a *Anagent) InvokeIsolated(handler Handler, values ...interface{}) ([]reflect.Value, error) {
+	child := inject.New()
+	child.SetParent(a)
+	for _, v := range values {
+		child.Map(v)
+		if err, ok := v.(error); ok {
+			child.MapTo(err, (*error)(nil))
+		}
+	}
+
+	return a.call(child, validateAndWrapHandler(handler))
+}
+
 // Handlers sets the entire middleware stack with the given Handlers.
 // This will clear any current middleware handlers,
 // and panics if any of the handlers is not a callable function
 func (a *Anagent) Handlers(handlers ...Handler) {
-	a.handlers = make([]Handler, 0)
+	a.Lock()
+	a.handlers = make([]*middleware, 0)
+	atomic.StoreInt32(&a.handlersCount, 0)
+	a.Unlock()
 	for _, handler := range handlers {
 		a.Use(handler)
 	}
@@ -117,8 +457,19 @@ func (a *Anagent) Handlers(handlers ...Handler) {
 
 // Emitter returns the internal *emission.Emitter used structure
 // use this to access directly to the Emitter, and override
-// the dependency-injection features
+// the dependency-injection features.
+// It returns nil if a different Emitter was supplied with WithEmitter,
+// use EventEmitter to access it.
 func (a *Anagent) Emitter() *emission.Emitter {
+	if def, ok := a.ee.(*emissionEmitter); ok {
+		return def.ee
+	}
+	return nil
+}
+
+// EventEmitter returns the Emitter used by the agent,
+// either the default one or the one supplied with WithEmitter.
+func (a *Anagent) EventEmitter() Emitter {
 	return a.ee
 }
 
@@ -138,14 +489,154 @@ func (a *Anagent) Next(handler Handler) {
 	a.AddTimerSeconds(0, handler)
 }
 
+// tickTask is a Handler run after a number of Steps.
+type tickTask struct {
+	remaining int
+	handler   Handler
+}
+
+// AfterTicks runs the handler during the n-th Step from now,
+// regardless of the time passed meanwhile.
+// A value of n lower than 1 runs it on the next Step.
+// It panics if the handler is not a callable func.
+func (a *Anagent) AfterTicks(n int, handler Handler) {
+	a.Lock()
+	defer a.Unlock()
+	a.tickTasks = append(a.tickTasks, &tickTask{remaining: n, handler: validateAndWrapHandler(handler)})
+	atomic.StoreInt32(&a.tickTasksCount, int32(len(a.tickTasks)))
+	a.interrupt()
+}
+
+// runTickTasks counts down the tasks registered with AfterTicks,
+// and runs the ones that are due.
+func (a *Anagent) runTickTasks() {
+	a.Lock()
+	due := []Handler{}
+	pending := a.tickTasks[:0]
+	for _, task := range a.tickTasks {
+		task.remaining--
+		if task.remaining <= 0 {
+			due = append(due, task.handler)
+		} else {
+			pending = append(pending, task)
+		}
+	}
+	a.tickTasks = pending
+	atomic.StoreInt32(&a.tickTasksCount, int32(len(pending)))
+	a.Unlock()
+
+	for _, h := range due {
+		a.runTask(h)
+	}
+}
+
 // Use adds a middleware Handler to the stack,
 // and panics if the handler is not a callable func.
 // Middleware Handlers are invoked in the order that they are added.
 func (a *Anagent) Use(handler Handler) {
+	a.UseEveryN(1, handler)
+}
+
+// UseEveryN adds a middleware Handler to the stack that runs
+// only every n ticks (on ticks 0, n, 2n, ...), where a tick is a Step.
+// It panics if the handler is not a callable func or if n is less than 1.
+func (a *Anagent) UseEveryN(n int, handler Handler) {
+	if n < 1 {
+		panic("Anagent UseEveryN requires n to be greater than zero")
+	}
+	a.use(&middleware{handler: validateAndWrapHandler(handler), every: uint64(n)})
+}
+
+// UsePriority adds a middleware Handler to the stack with the given priority,
+// and panics if the handler is not a callable func.
+// Handlers with a lower priority are invoked first, Handlers sharing
+// the same priority are invoked in the order that they are added.
+// Handlers added with Use have priority 0.
+func (a *Anagent) UsePriority(priority int, handler Handler) {
+	a.use(&middleware{handler: validateAndWrapHandler(handler), every: 1, priority: priority})
+}
+
+// WarnOnDuplicateHandler sets whether a warning is logged when a handler
+// already present in the middleware stack is added again.
+func (a *Anagent) WarnOnDuplicateHandler(warn bool) {
 	a.Lock()
 	defer a.Unlock()
-	handler = validateAndWrapHandler(handler)
-	a.handlers = append(a.handlers, handler)
+	a.warnDuplicates = warn
+}
+
+// SetMaxHandlers caps the middleware stack to n handlers: adding
+// a handler beyond the cap panics. A value lower than 1 removes the cap.
+func (a *Anagent) SetMaxHandlers(n int) {
+	a.Lock()
+	defer a.Unlock()
+	a.maxHandlers = n
+}
+
+// UseNamed adds a middleware Handler to the stack with the given name and
+// priority, like UsePriority. The name is reported by HandlerOrder.
+func (a *Anagent) UseNamed(name string, priority int, handler Handler) {
+	a.use(&middleware{name: name, handler: validateAndWrapHandler(handler), every: 1, priority: priority})
+}
+
+// HandlerOrder returns the names of the middleware Handlers in the order
+// they are invoked in a Step. Handlers added without a name are reported
+// with the name of their function. Handlers added with UseEveryN are
+// reported even if they don't run on every Step.
+func (a *Anagent) HandlerOrder() []string {
+	a.Lock()
+	defer a.Unlock()
+	names := make([]string, len(a.handlers))
+	for i, m := range a.handlers {
+		names[i] = m.name
+		if names[i] == "" {
+			names[i] = handlerName(m.handler)
+		}
+	}
+	return names
+}
+
+// SetMiddlewareEnabled enables or disables the middleware stack.
+// While disabled, Step doesn't run the middleware Handlers,
+// but timers keep firing. The stack is left untouched.
+func (a *Anagent) SetMiddlewareEnabled(enabled bool) {
+	a.Lock()
+	defer a.Unlock()
+	a.middlewareDisabled = !enabled
+}
+
+// MiddlewareEnabled returns a boolean indicating if the middleware stack is enabled
+func (a *Anagent) MiddlewareEnabled() bool {
+	a.Lock()
+	defer a.Unlock()
+	return !a.middlewareDisabled
+}
+
+// use inserts the middleware in the stack, keeping it sorted by priority.
+func (a *Anagent) use(m *middleware) {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.maxHandlers > 0 && len(a.handlers) >= a.maxHandlers {
+		panic("Anagent middleware stack exceeds the maximum number of handlers")
+	}
+	if a.warnDuplicates {
+		ptr := reflect.ValueOf(m.handler).Pointer()
+		for _, h := range a.handlers {
+			if reflect.ValueOf(h.handler).Pointer() == ptr {
+				a.Log().Printf("warning: middleware %s added more than once", handlerName(m.handler))
+				break
+			}
+		}
+	}
+
+	i := sort.Search(len(a.handlers), func(i int) bool {
+		return a.handlers[i].priority > m.priority
+	})
+	a.handlers = append(a.handlers, nil)
+	copy(a.handlers[i+1:], a.handlers[i:])
+	a.handlers[i] = m
+	atomic.StoreInt32(&a.handlersCount, int32(len(a.handlers)))
+	a.interrupt()
 }
 
 // TimerSeconds is used to set a timer, that will fire after the seconds supplied.
@@ -156,7 +647,7 @@ func (a *Anagent) TimerSeconds(seconds int64, recurring bool, handler Handler) T
 	handler = validateAndWrapHandler(handler)
 	dt := time.Duration(seconds) * time.Second
 
-	return a.Timer(TimerID(""), time.Now().Add(dt), dt, recurring, handler)
+	return a.Timer(TimerID(""), a.now().Add(dt), dt, recurring, handler)
 }
 
 // Timer is used to set a generic timer.
@@ -168,174 +659,1560 @@ func (a *Anagent) TimerSeconds(seconds int64, recurring bool, handler Handler) T
 // a boolean to set it as recurring or not
 // and at the end the callback to be fired at the desired time.
 func (a *Anagent) Timer(tid TimerID, ti time.Time, after time.Duration, recurring bool, handler Handler) TimerID {
-	var id TimerID
-	if tid != "" {
-		id = tid
-	} else {
-		id = TimerID(GetMD5Hash(time.Now().String()))
-	}
-
-	handler = validateAndWrapHandler(handler)
-	t := &Timer{handler: handler, time: ti, after: after, recurring: recurring}
-	a.timers[id] = t
-
+	id, _ := a.TimerErr(tid, ti, after, recurring, handler)
 	return id
 }
 
-// RemoveTimer is used to set a remove a timer from the loop.
-// It requires a TimerID
-func (a *Anagent) RemoveTimer(id TimerID) {
-	delete(a.timers, id)
+// TimerErr is like Timer, but it returns ErrTooManyTimers when the timer is
+// rejected because the cap set with SetMaxTimers is reached. In such case
+// Timer returns an empty TimerID.
+func (a *Anagent) TimerErr(tid TimerID, ti time.Time, after time.Duration, recurring bool, handler Handler) (TimerID, error) {
+	handler = validateAndWrapHandler(handler)
+	return a.addTimer(tid, &Timer{handler: handler, time: ti, after: after, recurring: recurring})
 }
 
-// GetTimer is used to set a get a timer from the loop.
-// It requires a TimerID
-func (a *Anagent) GetTimer(id TimerID) *Timer {
-	return a.timers[id]
-}
+// addTimer inserts the timer, looking for a duplicate and applying the
+// timers cap in the same critical section of the insertion. A generated ID
+// taken in the meantime by another timer is generated again.
+func (a *Anagent) addTimer(tid TimerID, t *Timer) (TimerID, error) {
+	id := tid
+	for {
+		if tid == "" {
+			id = a.nextID()
+		}
+		a.Lock()
+		if _, used := a.timers[id]; tid != "" || !used {
+			break
+		}
+		a.Unlock()
+	}
 
-// SetDuration is used to change the duration of a timer.
-// It requires a TimerID and a time.Duration
-func (a *Anagent) SetDuration(id TimerID, after time.Duration) TimerID {
-	a.timers[id].after = after
-	return id
-}
+	if a.DedupeTimers && t.recurring && t.cron == nil {
+		if existing, ok := a.findTimer(t.handler, t.after); ok {
+			a.Unlock()
+			return existing, nil
+		}
+	}
+	op := Operation{Op: OpTimer, TimerID: id, At: t.time, After: t.after, Recurring: t.recurring, Handler: handlerName(t.handler)}
+	if t.cron != nil {
+		op.Cron = t.cron.spec
+	}
+	evicted, ok := a.makeRoom(id, t)
+	if ok {
+		t.seq = atomic.AddUint64(&a.timerSeq, 1)
+		a.timers[id] = t
+	}
+	a.Unlock()
 
-// AddTimerSeconds is used to set a non recurring timer,
-// that will fire after the seconds supplied.
-// It requires seconds supplied as int64
-// and at the end the callback to be fired at the desired time.
-func (a *Anagent) AddTimerSeconds(seconds int64, handler Handler) TimerID {
-	return a.TimerSeconds(seconds, false, handler)
+	for _, e := range evicted {
+		a.publish(TimerRemoved, e)
+		a.record(Operation{Op: OpRemove, TimerID: e})
+	}
+	if !ok {
+		return "", ErrTooManyTimers
+	}
+	a.publish(TimerAdded, id)
+	a.record(op)
+	a.interrupt()
+
+	return id, nil
 }
 
-// AddRecurringTimerSeconds is used to set a recurring timer,
-// that will fire after the seconds supplied.
-// It requires seconds supplied as int64
-// and at the end the callback to be fired at the desired time.
-func (a *Anagent) AddRecurringTimerSeconds(seconds int64, handler Handler) TimerID {
-	return a.TimerSeconds(seconds, true, handler)
+// SetMaxTimers caps the number of timers of the agent to n, applying
+// the policy when a new timer would exceed it. A cap lower than 1 removes it.
+func (a *Anagent) SetMaxTimers(n int, policy TimersPolicy) {
+	a.Lock()
+	defer a.Unlock()
+	a.maxTimers = n
+	a.timersPolicy = policy
 }
 
-// New creates a bare bones Anagent instance.
-// Use this method if you want to have full control over the middleware that is used.
-func New() *Anagent {
-	ts := make(map[TimerID]*Timer)
-	a := &Anagent{
-		BusyLoop:      false,
-		Injector:      inject.New(),
-		ee:            emission.NewEmitter(),
-		timers:        ts,
-		StartedAccess: &sync.Mutex{},
+// makeRoom applies the timers cap before adding the timer with the given id,
+// and returns the evicted timers and false if the timer has to be rejected.
+// With TimersEvictFurthest the new timer is rejected as well when it is
+// the furthest out. It must be called with the lock held.
+func (a *Anagent) makeRoom(id TimerID, t *Timer) (evicted []TimerID, ok bool) {
+	if _, ok := a.timers[id]; ok || a.maxTimers < 1 {
+		return nil, true
 	}
-
-	a.Map(a)
-	a.Map(a.ee)
-
-	return a
+	for len(a.timers) >= a.maxTimers {
+		if a.timersPolicy != TimersEvictFurthest {
+			return evicted, false
+		}
+		furthest, at, found := a.scanTimers(func(_ TimerID, t *Timer, _ TimerID, best *Timer) bool { return t.time.After(best.time) })
+		if !found || !at.After(t.time) {
+			return evicted, false
+		}
+		delete(a.timers, furthest)
+		a.dropDuration(furthest)
+		evicted = append(evicted, furthest)
+	}
+	return evicted, true
 }
 
-func (a *Anagent) runAll() {
+// SetIDGenerator sets the function generating the IDs of the timers
+// created with an empty TimerID. By default IDs are generated
+// by a counter. A nil generator restores the default.
+func (a *Anagent) SetIDGenerator(gen func() TimerID) {
 	a.Lock()
 	defer a.Unlock()
-	var i = 0
-
-	for i < len(a.handlers) {
-		//var err error
-
-		//_, err = a.Invoke(a.handlers[i]) // was vals
-
-		//if err != nil && a.Fatal {
-		//	panic(err)
-		//}
-		a.Invoke(a.handlers[i])
+	a.idGenerator = gen
+}
 
-		i++
+// nextID generates an ID for a new timer,
+// skipping the ones used by the existing timers.
+func (a *Anagent) nextID() TimerID {
+	a.Lock()
+	gen := a.idGenerator
+	a.Unlock()
+	if gen == nil {
+		gen = func() TimerID {
+			return TimerID(strconv.FormatUint(atomic.AddUint64(&a.idCounter, 1), 10))
+		}
 	}
-}
 
-// RunLoop starts a loop that never returns
-func (a *Anagent) RunLoop() {
 	for {
-		a.Step()
+		id := gen()
+		a.Lock()
+		_, used := a.timers[id]
+		a.Unlock()
+		if !used {
+			return id
+		}
 	}
 }
 
-// IsStarted returns a boolean indicating if we started the loop with Start()
-func (a *Anagent) IsStarted() bool {
-	a.StartedAccess.Lock()
-	defer a.StartedAccess.Unlock()
-	return a.Started
+// findTimer looks for a recurring timer with the given handler and interval,
+// cron timers are ignored.
+// It must be called with the lock held.
+func (a *Anagent) findTimer(handler Handler, after time.Duration) (TimerID, bool) {
+	ptr := reflect.ValueOf(handler).Pointer()
+	for id, t := range a.timers {
+		if t.recurring && t.cron == nil && t.after == after && reflect.ValueOf(t.handler).Pointer() == ptr {
+			return id, true
+		}
+	}
+	return "", false
 }
 
-// Start starts the agent loop and never returns. ( unless you call Stop() )
-func (a *Anagent) Start() {
+// RemoveTimer is used to set a remove a timer from the loop.
+// It requires a TimerID
+func (a *Anagent) RemoveTimer(id TimerID) {
+	a.RemoveTimers(id)
+}
 
-	if a.Started == true {
-		return
+// RemoveTimers removes all the timers with the given IDs,
+// IDs of timers that don't exist are ignored.
+func (a *Anagent) RemoveTimers(ids ...TimerID) {
+	a.Lock()
+	removed := []TimerID{}
+	for _, id := range ids {
+		if _, ok := a.timers[id]; ok {
+			delete(a.timers, id)
+			a.dropDuration(id)
+			removed = append(removed, id)
+		}
 	}
-	a.Started = true
+	a.Unlock()
 
-	for a.IsStarted() {
-		a.Step()
+	for _, id := range removed {
+		a.publish(TimerRemoved, id)
+		a.record(Operation{Op: OpRemove, TimerID: id})
 	}
 }
 
-// Stop stops the agent loop, in case Start() was called.
-func (a *Anagent) Stop() {
-	a.StartedAccess.Lock()
-	defer a.StartedAccess.Unlock()
-	a.Started = false
+// TimerIDs returns the IDs of all the timers, in no particular order.
+// The slice is a copy, so it can be iterated while timers are removed.
+func (a *Anagent) TimerIDs() []TimerID {
+	a.Lock()
+	defer a.Unlock()
+	ids := make([]TimerID, 0, len(a.timers))
+	for id := range a.timers {
+		ids = append(ids, id)
+	}
+	return ids
 }
 
-// Step executes an agent step.
-// It is idempotent, and even if there are delays in timings
-// events gets executed in order as a best-effort in
-// respecting setted timers.
-func (a *Anagent) Step() {
-	a.runAll()
+// GetTimer is used to set a get a timer from the loop.
+// It requires a TimerID
+func (a *Anagent) GetTimer(id TimerID) *Timer {
+	a.Lock()
+	defer a.Unlock()
+	return a.timers[id]
+}
 
-	if len(a.timers) == 0 {
-		return
+// NextFire returns the time the timer is scheduled to fire at,
+// and false if the timer does not exist.
+// For a paused timer it is the time it was scheduled at when paused.
+func (a *Anagent) NextFire(id TimerID) (time.Time, bool) {
+	a.Lock()
+	defer a.Unlock()
+	t, ok := a.timers[id]
+	if !ok {
+		return time.Time{}, false
 	}
-
-	a.consumeTimer(a.bestTimer())
+	return t.time, true
 }
 
-func (a *Anagent) consumeTimer(mintimeid *TimerID, mintime *time.Time) {
-	now := time.Now()
+// SetDuration is used to change the duration of a timer.
+// It requires a TimerID and a time.Duration
+// Changes are coalesced: calls made in quick succession collapse to the
+// last value, which is applied before the next scheduling decision.
+// It returns false if the timer does not exist.
+func (a *Anagent) SetDuration(id TimerID, after time.Duration) (TimerID, bool) {
+	a.Lock()
+	defer a.Unlock()
+	if _, ok := a.timers[id]; !ok {
+		return id, false
+	}
+	if a.pendingDurations == nil {
+		a.pendingDurations = make(map[TimerID]time.Duration)
+	}
+	a.pendingDurations[id] = after
+	atomic.StoreInt32(&a.pendingCount, int32(len(a.pendingDurations)))
+	return id, true
+}
 
-	if mintime.After(now) {
-		if !a.BusyLoop {
-			time.Sleep(mintime.Sub(now))
-		} else {
-			return
+// applyDurations applies the durations set with SetDuration.
+// It must be called with the lock held.
+func (a *Anagent) applyDurations() {
+	if atomic.LoadInt32(&a.pendingCount) == 0 {
+		return
+	}
+	for id, after := range a.pendingDurations {
+		if t, ok := a.timers[id]; ok {
+			t.after = after
 		}
 	}
+	a.pendingDurations = nil
+	atomic.StoreInt32(&a.pendingCount, 0)
+}
+
+// dropDuration discards the duration set with SetDuration for the timer,
+// if it wasn't applied yet. It must be called with the lock held.
+func (a *Anagent) dropDuration(id TimerID) {
+	if _, ok := a.pendingDurations[id]; ok {
+		delete(a.pendingDurations, id)
+		atomic.StoreInt32(&a.pendingCount, int32(len(a.pendingDurations)))
+	}
+}
 
-	a.Invoke(a.timers[*mintimeid].handler)
+// Reconfigure updates atomically the next fire, the interval and the
+// recurrence of a timer, so the change takes effect immediately.
+// It requires a TimerID, and returns false if the timer does not exist.
+func (a *Anagent) Reconfigure(id TimerID, nextFire time.Time, interval time.Duration, recurring bool) bool {
 	a.Lock()
 	defer a.Unlock()
-	if a.timers[*mintimeid].recurring == true {
-		a.timers[*mintimeid].time = time.Now().Add(a.timers[*mintimeid].after)
-	} else {
-		delete(a.timers, *mintimeid)
+	t, ok := a.timers[id]
+	if !ok {
+		return false
 	}
+	t.time = nextFire
+	t.after = interval
+	t.recurring = recurring
+	a.dropDuration(id)
+	a.rescheduleDependents(id, t)
+	a.interrupt()
+	return true
 }
 
-func (a *Anagent) bestTimer() (*TimerID, *time.Time) {
-	mintimeid, timer := RandTimer(a.timers)
-	mintime := timer.time
-
+// SetLabel is used to attach a human-readable label to a timer.
+// It requires a TimerID and the label, and returns false
+// if the timer does not exist.
+func (a *Anagent) SetLabel(id TimerID, label string) bool {
 	a.Lock()
 	defer a.Unlock()
+	t, ok := a.timers[id]
+	if !ok {
+		return false
+	}
+	t.label = label
+	return true
+}
+
+// Label returns the label attached to a timer.
+// It requires a TimerID
+func (a *Anagent) Label(id TimerID) string {
+	a.Lock()
+	defer a.Unlock()
+	if t, ok := a.timers[id]; ok {
+		return t.label
+	}
+	return ""
+}
+
+// TimersByLabelPrefix returns the IDs of the timers whose label
+// starts with the prefix, sorted.
+func (a *Anagent) TimersByLabelPrefix(prefix string) []TimerID {
+	a.Lock()
+	defer a.Unlock()
+	ids := []TimerID{}
+	for id, t := range a.timers {
+		if t.label != "" && strings.HasPrefix(t.label, prefix) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// SetConcurrent sets whether the timer handler has to be run in its own
+// goroutine when fired, so the loop doesn't wait for it to complete.
+// Recurring timers are rescheduled immediately, without waiting for the handler.
+// It requires a TimerID, and returns false if the timer does not exist.
+//
+// Concurrent handlers share the agent injector with the loop:
+// they can safely receive the mapped services, but mapping services
+// while concurrent handlers are running is not safe.
+func (a *Anagent) SetConcurrent(id TimerID, concurrent bool) bool {
+	a.Lock()
+	defer a.Unlock()
+	t, ok := a.timers[id]
+	if !ok {
+		return false
+	}
+	t.concurrent = concurrent
+	return true
+}
+
+// FixedRate sets whether a recurring timer has to fire at a fixed rate:
+// the next fire is computed from the previous scheduled time instead of
+// the handler completion, so the handler duration doesn't cause drift.
+// Missed fires are skipped when the loop is behind.
+// It requires a TimerID, and returns false if the timer does not exist.
+func (a *Anagent) FixedRate(id TimerID, fixed bool) bool {
+	a.Lock()
+	defer a.Unlock()
+	t, ok := a.timers[id]
+	if !ok {
+		return false
+	}
+	t.fixedRate = fixed
+	return true
+}
+
+// TriggerAll moves the next fire of every timer to now, so they all fire
+// on the upcoming Steps. Timers that are already due are left untouched,
+// and the intervals of recurring timers are not altered.
+func (a *Anagent) TriggerAll() {
+	a.Lock()
+	defer a.Unlock()
+
+	now := a.now()
+	for _, t := range a.timers {
+		if t.time.After(now) {
+			t.time = now
+		}
+	}
+	a.interrupt()
+}
+
+// FireWhen sets a predicate that gates the fires of a timer:
+// the predicate is invoked with dependency injection when the timer is due,
+// and if it returns false the fire is skipped, while the schedule is kept.
+// Recurring timers are rescheduled as usual, one-shot timers are removed.
+// It requires a TimerID and a callable function returning a bool, and
+// returns false if the timer does not exist. It panics if the predicate is invalid.
+// A nil predicate removes the gate.
+func (a *Anagent) FireWhen(id TimerID, predicate Handler) bool {
+	if predicate != nil {
+		t := reflect.TypeOf(validateAndWrapHandler(predicate))
+		if t.NumOut() != 1 || t.Out(0).Kind() != reflect.Bool {
+			panic("Anagent FireWhen predicate must return a bool")
+		}
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	t, ok := a.timers[id]
+	if !ok {
+		return false
+	}
+	t.when = predicate
+	return true
+}
+
+// allowed invokes a FireWhen predicate, an injection failure
+// is considered as a false result.
+func (a *Anagent) allowed(predicate Handler) bool {
+	vals, err := a.call(a.Injector, predicate)
+	return err == nil && vals[0].Bool()
+}
+
+// MinFireInterval sets a minimum interval between two fires of a timer:
+// the timer never fires more often than d, even if its interval or
+// its schedule would make it fire sooner. A zero duration removes the floor.
+// It requires a TimerID, and returns false if the timer does not exist.
+func (a *Anagent) MinFireInterval(id TimerID, d time.Duration) bool {
+	a.Lock()
+	defer a.Unlock()
+	t, ok := a.timers[id]
+	if !ok {
+		return false
+	}
+	t.minFire = d
+	return true
+}
+
+// PauseTimer suspends a timer: it doesn't fire until ResumeTimer is called.
+// It can be called from the timer handler itself: the running execution
+// completes undisturbed, and the timer is paused from its next fire.
+// It requires a TimerID, and returns false if the timer does not exist.
+func (a *Anagent) PauseTimer(id TimerID) bool {
+	a.Lock()
+	defer a.Unlock()
+	t, ok := a.timers[id]
+	if !ok {
+		return false
+	}
+	if !t.paused {
+		t.paused = true
+		t.pausedAt = a.now()
+	}
+	return true
+}
+
+// ResumeTimer resumes a timer suspended with PauseTimer. The timer fires
+// after the time that was remaining to its next fire when it was paused.
+// It requires a TimerID, and returns false if the timer does not exist.
+func (a *Anagent) ResumeTimer(id TimerID) bool {
+	a.Lock()
+	defer a.Unlock()
+	t, ok := a.timers[id]
+	if !ok {
+		return false
+	}
+	if t.paused {
+		now := a.now()
+		remaining := t.time.Sub(t.pausedAt)
+		if remaining < 0 {
+			remaining = 0
+		}
+		t.time = now.Add(remaining)
+		t.paused = false
+		a.rescheduleDependents(id, t)
+		a.interrupt()
+	}
+	return true
+}
 
+// SetMaxConcurrency limits the number of concurrent timer handlers
+// that can run at the same time. Handlers exceeding the limit
+// wait in their goroutine for a free slot, without blocking the loop.
+// A value lower than 1 removes the limit.
+func (a *Anagent) SetMaxConcurrency(n int) {
+	a.Lock()
+	defer a.Unlock()
+	if n < 1 {
+		a.concurrency = nil
+		return
+	}
+	a.concurrency = make(chan struct{}, n)
+}
+
+// invokeConcurrent invokes the timer handler in its own goroutine, or on
+// the worker pool, respecting the limit set with SetMaxConcurrency.
+// The returned function is called once the handler returned.
+func (a *Anagent) invokeConcurrent(id TimerID, label string, handler Handler, lock *sync.Mutex, values map[interface{}]interface{}, returned func()) {
+	a.Lock()
+	sem := a.concurrency
+	a.Unlock()
+
+	a.goPooled(func() {
+		defer returned()
+		if sem != nil {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+		}
+		a.invokeTimer(id, label, handler, lock, values)
+	})
+}
+
+// invokeTimer invokes a timer handler, holding its lock if it has one.
+// If the timer has context values, they are carried by a context.Context
+// mapped for the handler only, otherwise the handler gets the one mapped
+// in the agent, context.Background() by default.
+func (a *Anagent) invokeTimer(id TimerID, label string, handler Handler, lock *sync.Mutex, values map[interface{}]interface{}) {
+	if lock != nil {
+		lock.Lock()
+		defer lock.Unlock()
+	}
+
+	var inj inject.Injector = a.Injector
+	if len(values) > 0 {
+		ctx := context.Background()
+		for k, v := range values {
+			ctx = context.WithValue(ctx, k, v)
+		}
+		inj = inject.New()
+		inj.SetParent(a)
+		inj.MapTo(ctx, (*context.Context)(nil))
+	}
+	start := time.Now()
+	var err error
+	a.runHandler(func() {
+		if a.RecoverPanics {
+			defer a.recoverPanic(&err)
+		}
+		err = a.invokeProfiled(inj, label, handler)
+	})
+	a.timerResult(id, err, time.Since(start))
+}
+
+// SetTimerContext attaches a value to a timer under the key. The handler
+// of a timer with values can receive a context.Context carrying them by
+// injection, while the handlers of the other timers get context.Background().
+// It requires a TimerID, and returns false if the timer does not exist.
+func (a *Anagent) SetTimerContext(id TimerID, key, value interface{}) bool {
+	a.Lock()
+	defer a.Unlock()
+	t, ok := a.timers[id]
+	if !ok {
+		return false
+	}
+	values := make(map[interface{}]interface{}, len(t.values)+1)
+	for k, v := range t.values {
+		values[k] = v
+	}
+	values[key] = value
+	t.values = values
+	return true
+}
+
+// SetTimerLock sets a mutex held while the timer handler runs, so timers
+// sharing the same mutex, even across agents, never run at the same time.
+// A nil mutex removes the lock.
+// It requires a TimerID, and returns false if the timer does not exist.
+func (a *Anagent) SetTimerLock(id TimerID, lock *sync.Mutex) bool {
+	a.Lock()
+	defer a.Unlock()
+	t, ok := a.timers[id]
+	if !ok {
+		return false
+	}
+	t.lock = lock
+	return true
+}
+
+// AtNextBoundary sets a non recurring timer firing at the next multiple
+// of unit, e.g. with time.Minute it fires at the start of the next minute.
+// It panics if unit is not positive or the handler is not a callable func.
+func (a *Anagent) AtNextBoundary(unit time.Duration, handler Handler) TimerID {
+	if unit <= 0 {
+		panic("Anagent AtNextBoundary unit must be positive")
+	}
+	now := a.now()
+	at := now.Truncate(unit).Add(unit)
+	return a.Timer(TimerID(""), at, at.Sub(now), false, handler)
+}
+
+// TimerMaxRuns limits a recurring timer to max fires, after which
+// it is removed. A zero max means unlimited, the default.
+// It requires a TimerID, and returns false if the timer does not exist.
+func (a *Anagent) TimerMaxRuns(id TimerID, max int) bool {
+	a.Lock()
+	defer a.Unlock()
+	t, ok := a.timers[id]
+	if !ok {
+		return false
+	}
+	t.maxRuns = max
+	return true
+}
+
+// TimerRuns returns how many times the timer fired,
+// or 0 if the timer does not exist.
+func (a *Anagent) TimerRuns(id TimerID) int {
+	a.Lock()
+	defer a.Unlock()
+	if t, ok := a.timers[id]; ok {
+		return t.runs
+	}
+	return 0
+}
+
+// AddTimerSeconds is used to set a non recurring timer,
+// that will fire after the seconds supplied.
+// It requires seconds supplied as int64
+// and at the end the callback to be fired at the desired time.
+func (a *Anagent) AddTimerSeconds(seconds int64, handler Handler) TimerID {
+	return a.TimerSeconds(seconds, false, handler)
+}
+
+// TimerThen sets a non recurring timer that will fire after d,
+// and invokes then with its TimerID once the handler returned and the
+// timer was removed. then is invoked even if the handler panicked, or if
+// the fire was skipped, e.g. by FireWhen, but not if the timer is removed
+// with RemoveTimer. It panics if the handler is not a callable func.
+func (a *Anagent) TimerThen(d time.Duration, handler Handler, then func(id TimerID)) TimerID {
+	handler = validateAndWrapHandler(handler)
+	id, _ := a.addTimer(TimerID(""), &Timer{handler: handler, time: a.now().Add(d), after: d, then: then})
+	return id
+}
+
+// runThen invokes the completion callback set with TimerThen. If the
+// handler is running concurrently, the callback waits for it on its own.
+func (a *Anagent) runThen(id TimerID, then func(TimerID), done <-chan struct{}) {
+	if done == nil {
+		then(id)
+		return
+	}
+	a.spawn(func() {
+		<-done
+		then(id)
+	})
+}
+
+// thenOnPanic removes the one-shot timer whose handler panicked,
+// invoking its completion callback before propagating the panic.
+// It must be deferred directly.
+func (a *Anagent) thenOnPanic(id TimerID, t *Timer) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	a.Lock()
+	removed := a.timers[id] == t && !t.recurring
+	if removed {
+		delete(a.timers, id)
+	}
+	a.Unlock()
+	if removed {
+		a.publish(TimerRemoved, id)
+		t.then(id)
+	}
+	panic(r)
+}
+
+// AddRecurringTimerSeconds is used to set a recurring timer,
+// that will fire after the seconds supplied.
+// It requires seconds supplied as int64
+// and at the end the callback to be fired at the desired time.
+func (a *Anagent) AddRecurringTimerSeconds(seconds int64, handler Handler) TimerID {
+	return a.TimerSeconds(seconds, true, handler)
+}
+
+// New creates a bare bones Anagent instance.
+// Use this method if you want to have full control over the middleware that is used.
+func New() *Anagent {
+	ts := make(map[TimerID]*Timer)
+	a := &Anagent{
+		BusyLoop:      false,
+		Injector:      inject.New(),
+		timers:        ts,
+		wake:          make(chan struct{}, 1),
+		logger:        log.New(os.Stderr, "[Anagent] ", log.LstdFlags),
+		StartedAccess: &sync.Mutex{},
+	}
+
+	a.goroutinesDone = sync.NewCond(&a.goroutinesAccess)
+
+	ee := emission.NewEmitter()
+	a.ee = &emissionEmitter{ee: ee}
+
+	a.Map(a)
+	a.Map(ee)
+	a.MapTo(a.ee, (*Emitter)(nil))
+	a.Map(a.logger)
+	a.log = a.logger
+	a.MapTo(a.log, (*Logger)(nil))
+	a.MapTo(context.Background(), (*context.Context)(nil))
+
+	return a
+}
+
+// WithName sets the agent name, which is shown in the logger prefix,
+// to tell apart several agents logging to the same output.
+func WithName(name string) Option {
+	return func(a *Anagent) {
+		a.name = name
+		a.logger.SetPrefix("[Anagent:" + name + "] ")
+	}
+}
+
+// Name returns the agent name, set with WithName.
+func (a *Anagent) Name() string {
+	return a.name
+}
+
+// NewWithOptions creates a bare bones Anagent instance,
+// and applies the given options to it.
+func NewWithOptions(opts ...Option) *Anagent {
+	a := New()
+	for _, opt := range opts {
+		opt(a)
+	}
+
+	return a
+}
+
+// runAll runs the middleware stack. The stack is copied under the lock,
+// and the handlers are invoked without holding it, so they can call back
+// into the agent.
+func (a *Anagent) runAll(tick uint64) {
+	a.Lock()
+	if a.middlewareDisabled {
+		a.Unlock()
+		return
+	}
+	handlers := append([]*middleware{}, a.handlers...)
+	a.Unlock()
+	var i = 0
+
+	for i < len(handlers) {
+		if tick%handlers[i].every == 0 && !a.runMiddleware(handlers[i].handler) {
+			return
+		}
+
+		i++
+	}
+}
+
+// RunLoop starts a loop that never returns
+func (a *Anagent) RunLoop() {
+	for {
+		a.Step()
+	}
+}
+
+// RunUntil runs Steps until the predicate, evaluated after each Step,
+// returns true, then stops the agent.
+// If max is greater than zero, it gives up after that duration
+// and returns false, so tests can't hang forever.
+func (a *Anagent) RunUntil(predicate func() bool, max time.Duration) bool {
+	a.StartedAccess.Lock()
+	a.Started = true
+	a.StartedAccess.Unlock()
+	defer a.Stop()
+
+	start := time.Now()
+	for {
+		a.Step()
+		if predicate() {
+			return true
+		}
+		if max > 0 && time.Since(start) >= max {
+			return false
+		}
+	}
+}
+
+// Ticks returns the number of Steps executed since the loop
+// was started with Start(), or since the agent creation.
+func (a *Anagent) Ticks() uint64 {
+	return atomic.LoadUint64(&a.ticks)
+}
+
+// IsStarted returns a boolean indicating if we started the loop with Start()
+func (a *Anagent) IsStarted() bool {
+	a.StartedAccess.Lock()
+	defer a.StartedAccess.Unlock()
+	return a.Started
+}
+
+// Start starts the agent loop and never returns. ( unless you call Stop() )
+func (a *Anagent) Start() {
+	a.run(context.Background())
+}
+
+// StartContext starts the agent loop like Start, and returns either when
+// Stop() is called or when the context is cancelled. The cancellation
+// wakes up the loop if it is sleeping waiting for a timer.
+// If the context is already cancelled, it returns at once.
+func (a *Anagent) StartContext(ctx context.Context) {
+	a.run(ctx)
+}
+
+// run runs the agent loop until it is stopped or the context is cancelled.
+func (a *Anagent) run(ctx context.Context) {
+	done, ok := a.begin(ctx)
+	if !ok {
+		return
+	}
+	defer close(done)
+	if ctx.Done() != nil {
+		finished := make(chan struct{})
+		defer close(finished)
+		a.spawn(func() {
+			select {
+			case <-ctx.Done():
+				a.StartedAccess.Lock()
+				if a.done == done {
+					a.Started = false
+					a.interrupt()
+				}
+				a.StartedAccess.Unlock()
+			case <-finished:
+			}
+		})
+	}
+	if !a.startup() {
+		return
+	}
+
+	for a.IsStarted() {
+		if !a.waitStepThrough() {
+			continue
+		}
+		a.Step()
+		if a.IsPaused() || a.idle() {
+			<-a.wake
+		}
+	}
+	a.shutdown()
+}
+
+// idle returns true if the loop has nothing to do until it is woken up:
+// there are no middlewares nor tasks to run, and no timers that are not
+// paused. Adding them, or resuming a timer, wakes up the loop.
+func (a *Anagent) idle() bool {
+	if a.BusyLoop || atomic.LoadInt32(&a.handlersCount) > 0 ||
+		atomic.LoadInt32(&a.tickTasksCount) > 0 || atomic.LoadInt32(&a.pendingCount) > 0 {
+		return false
+	}
+	a.Lock()
+	defer a.Unlock()
+	return !a.scheduled()
+}
+
+// scheduled returns true if there are timers that are not paused.
+// It must be called with the lock held.
+func (a *Anagent) scheduled() bool {
+	for _, t := range a.timers {
+		if !t.paused {
+			return true
+		}
+	}
+	return false
+}
+
+// begin marks the agent as started, returning the channel to close
+// once it stops. It returns false if the agent can't be started,
+// applying the double start policy if it is already started.
+func (a *Anagent) begin(ctx context.Context) (chan struct{}, bool) {
+	a.StartedAccess.Lock()
+	if a.Started {
+		a.StartedAccess.Unlock()
+		a.doubleStart()
+		return nil, false
+	}
+	if a.stoppedEarly || ctx.Err() != nil {
+		a.StartedAccess.Unlock()
+		return nil, false
+	}
+	a.Started = true
+	done := make(chan struct{})
+	a.done = done
+	a.flushOnce = false
+	a.drainOnce = false
+	a.StartedAccess.Unlock()
+	return done, true
+}
+
+// startup runs the startup tasks and the OnStart hooks of the agent
+// just started. It returns false, stopping the agent, if a startup
+// task failed, in which case the agent stops without its OnStop hooks.
+func (a *Anagent) startup() bool {
+	atomic.StoreUint64(&a.ticks, 0)
+	a.Lock()
+	a.warmUntil = a.now().Add(a.warmUp)
+	a.Unlock()
+	if !a.runStartupTasks() {
+		a.Stop()
+		return false
+	}
+	a.publish(AgentStarted, "")
+	if !a.runHooks(&a.onStart, &a.startPanicPolicy) {
+		a.Stop()
+	}
+	return true
+}
+
+// shutdown runs the drain, the flush and the OnStop hooks requested
+// for the agent that just stopped.
+func (a *Anagent) shutdown() {
+	a.StartedAccess.Lock()
+	flush := a.flushNextOnStop || a.flushOnce
+	drain := a.drainOnce
+	a.StartedAccess.Unlock()
+	if drain {
+		a.fireDue()
+	}
+	if flush {
+		a.flushNext()
+	}
+	a.runHooks(&a.onStop, &a.stopPanicPolicy)
+	a.publish(AgentStopped, "")
+}
+
+// SetDoubleStartPolicy sets what happens when Start is called
+// on an agent that is already started, by default it is ignored.
+func (a *Anagent) SetDoubleStartPolicy(policy DoubleStartPolicy) {
+	a.StartedAccess.Lock()
+	defer a.StartedAccess.Unlock()
+	a.doubleStartPolicy = policy
+}
+
+// StartErr returns ErrAlreadyStarted if Start was called on an agent
+// already started with the DoubleStartError policy, nil otherwise.
+func (a *Anagent) StartErr() error {
+	a.StartedAccess.Lock()
+	defer a.StartedAccess.Unlock()
+	return a.startErr
+}
+
+// doubleStart applies the double start policy.
+func (a *Anagent) doubleStart() {
+	a.StartedAccess.Lock()
+	defer a.StartedAccess.Unlock()
+	switch a.doubleStartPolicy {
+	case DoubleStartPanic:
+		panic(ErrAlreadyStarted)
+	case DoubleStartError:
+		a.startErr = ErrAlreadyStarted
+	}
+}
+
+// Pause suspends the agent: while paused, Step neither runs
+// the middlewares nor fires timers, until Resume is called.
+func (a *Anagent) Pause() {
+	a.StartedAccess.Lock()
+	defer a.StartedAccess.Unlock()
+	if !a.paused {
+		a.paused = true
+		a.publish(AgentPaused, "")
+	}
+}
+
+// Resume resumes an agent suspended with Pause.
+func (a *Anagent) Resume() {
+	a.StartedAccess.Lock()
+	defer a.StartedAccess.Unlock()
+	if a.paused {
+		a.paused = false
+		a.publish(AgentResumed, "")
+		a.interrupt()
+	}
+}
+
+// IsPaused returns a boolean indicating if the agent is paused
+func (a *Anagent) IsPaused() bool {
+	a.StartedAccess.Lock()
+	defer a.StartedAccess.Unlock()
+	return a.paused
+}
+
+// FlushNextOnStop sets whether the handlers scheduled with Next
+// that are still pending when the loop started with Start() is stopped
+// have to be run once before returning.
+func (a *Anagent) FlushNextOnStop(flush bool) {
+	a.StartedAccess.Lock()
+	defer a.StartedAccess.Unlock()
+	a.flushNextOnStop = flush
+}
+
+// flushNext runs and removes all the pending zero-delay timers.
+func (a *Anagent) flushNext() {
+	a.Lock()
+	pending := make([]TimerID, 0)
+	handlers := make(map[TimerID]*Timer)
+	for id, t := range a.timers {
+		if !t.recurring && t.after == 0 && t.base == "" {
+			pending = append(pending, id)
+			handlers[id] = t
+			delete(a.timers, id)
+		}
+	}
+	a.Unlock()
+
+	sort.SliceStable(pending, func(i, j int) bool {
+		return handlers[pending[i]].time.Before(handlers[pending[j]].time)
+	})
+	for _, id := range pending {
+		t := handlers[id]
+		a.runPooled(func() { a.invokeTimer(id, t.label, t.handler, t.lock, t.values) })
+		a.publish(TimerFired, id)
+		a.publish(TimerRemoved, id)
+	}
+}
+
+// Stop stops the agent loop, in case Start() was called.
+// If the loop is sleeping waiting for a timer, it is woken up
+// so Start() returns promptly.
+func (a *Anagent) Stop() {
+	a.StartedAccess.Lock()
+	defer a.StartedAccess.Unlock()
+	if !a.Started && a.stopPreventsStart {
+		a.stoppedEarly = true
+	}
+	a.Started = false
+	a.interrupt()
+}
+
+// StopPreventsStart sets whether calling Stop() on an agent that is not
+// started prevents it from starting: Start() then returns immediately,
+// until Reset is called. By default Stop() before Start() has no effect.
+func (a *Anagent) StopPreventsStart(prevent bool) {
+	a.StartedAccess.Lock()
+	defer a.StartedAccess.Unlock()
+	a.stopPreventsStart = prevent
+}
+
+// Reset clears the state left by a Stop() called before Start(),
+// and the error returned by StartErr, so the agent can be started again.
+func (a *Anagent) Reset() {
+	a.StartedAccess.Lock()
+	defer a.StartedAccess.Unlock()
+	a.stoppedEarly = false
+	a.startErr = nil
+}
+
+// EnableStepThrough makes the loop started with Start() wait before
+// each Step, until StepThrough is called, for debugging.
+func (a *Anagent) EnableStepThrough() {
+	a.StartedAccess.Lock()
+	defer a.StartedAccess.Unlock()
+	if a.stepThrough == nil {
+		a.stepThrough = make(chan struct{})
+	}
+}
+
+// StepThrough lets the loop run one Step, with EnableStepThrough.
+// It blocks until the loop is waiting for it.
+func (a *Anagent) StepThrough() {
+	a.StartedAccess.Lock()
+	gate := a.stepThrough
+	a.StartedAccess.Unlock()
+	if gate != nil {
+		gate <- struct{}{}
+	}
+}
+
+// waitStepThrough waits for StepThrough, if enabled, and returns
+// false if the loop was interrupted meanwhile.
+func (a *Anagent) waitStepThrough() bool {
+	a.StartedAccess.Lock()
+	gate := a.stepThrough
+	a.StartedAccess.Unlock()
+	if gate == nil {
+		return true
+	}
+
+	select {
+	case <-gate:
+		return true
+	case <-a.wake:
+		return false
+	}
+}
+
+// StopAndWait stops the loop started with Start(), and waits for Start()
+// to return. The pending handlers scheduled with Next are run once,
+// as with FlushNextOnStop, and the OnStop hooks are run as usual.
+// It must not be called from the handlers run by the loop.
+func (a *Anagent) StopAndWait() {
+	a.StartedAccess.Lock()
+	done := a.done
+	if a.Started {
+		a.flushOnce = true
+	}
+	a.StartedAccess.Unlock()
+
+	a.Stop()
+	if done != nil {
+		<-done
+	}
+}
+
+// StopAndDrain stops the loop started with Start(), firing once all the
+// timers that are already due before Start() returns, so pending work isn't
+// dropped. Recurring timers are not rescheduled after the drain, and the
+// OnStop hooks are run afterwards as usual. Unless it is called from a
+// handler run by the loop, it waits for Start() to return.
+// If the loop is not started, the due timers are fired at once.
+func (a *Anagent) StopAndDrain() {
+	a.StartedAccess.Lock()
+	done, started := a.done, a.Started
+	a.drainOnce = started
+	a.StartedAccess.Unlock()
+
+	a.Stop()
+	if !started {
+		a.fireDue()
+		return
+	}
+	if !a.InHandler() {
+		<-done
+	}
+}
+
+// fireDue fires once, in order, the timers that are due, removing
+// the one-shot ones once fired, while the recurring ones are not
+// rescheduled. The timers whose handler is running, e.g. the one
+// calling StopAndDrain, are skipped.
+// It waits for the handlers run concurrently to return.
+func (a *Anagent) fireDue() {
+	now := a.now()
+	a.Lock()
+	due := []TimerID{}
+	for id, t := range a.timers {
+		if !t.paused && t.running == 0 && !t.time.After(now) {
+			due = append(due, id)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return a.precedes(due[i], a.timers[due[i]], due[j], a.timers[due[j]])
+	})
+	a.Unlock()
+
+	running := []<-chan struct{}{}
+	for _, id := range due {
+		a.Lock()
+		t, ok := a.timers[id]
+		ok = ok && t.running == 0
+		a.Unlock()
+		if !ok {
+			continue
+		}
+		if done := a.fireDueTimer(id, t); done != nil {
+			running = append(running, done)
+		}
+	}
+	for _, done := range running {
+		<-done
+	}
+}
+
+// fireDueTimer fires a due timer for fireDue, removing it afterwards
+// if it is a one-shot timer, even if its handler panicked.
+func (a *Anagent) fireDueTimer(id TimerID, t *Timer) (done <-chan struct{}) {
+	if !t.recurring {
+		defer func() {
+			a.Lock()
+			removed := a.timers[id] == t
+			if removed {
+				delete(a.timers, id)
+			}
+			a.Unlock()
+			if removed {
+				a.publish(TimerRemoved, id)
+				if t.then != nil {
+					a.runThen(id, t.then, done)
+				}
+			}
+		}()
+	}
+	return a.fire(id, t, true)
+}
+
+// interrupt wakes up the loop if it is sleeping waiting for a timer,
+// so it can re-evaluate its state.
+func (a *Anagent) interrupt() {
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+}
+
+// sleep waits for the given duration, or until the loop is interrupted.
+// It returns false if the sleep was interrupted.
+func (a *Anagent) sleep(d time.Duration) bool {
+	if atomic.LoadInt32(&a.stepWaiters) > 0 {
+		return false
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-a.wake:
+		return false
+	}
+}
+
+// Step executes an agent step.
+// It is idempotent, and even if there are delays in timings
+// events gets executed in order as a best-effort in
+// respecting setted timers.
+// Handlers are invoked without holding the agent lock, so they can
+// safely call back into the agent. If Step is called from the running Step,
+// e.g. by a handler or by an event listener, it returns immediately instead
+// of reentering the loop: use TryStep to get an error. Steps called from
+// other goroutines wait for the running one to complete.
+func (a *Anagent) Step() {
+	a.TryStep()
+}
+
+// TryStep executes an agent step, like Step, and returns ErrReentrant
+// if it is called from the goroutine running a Step, from a listener
+// of an event emitted by the running Step, or from a handler.
+func (a *Anagent) TryStep() error {
+	if !a.stepAccess.TryLock() {
+		if a.stepping.contains() || a.InHandler() {
+			return ErrReentrant
+		}
+		// the running Step doesn't wait for timers while Steps are waiting
+		atomic.AddInt32(&a.stepWaiters, 1)
+		a.interrupt()
+		a.stepAccess.Lock()
+		atomic.AddInt32(&a.stepWaiters, -1)
+	}
+	defer a.stepAccess.Unlock()
+
+	a.stepping.run(a.step)
+	return nil
+}
+
+func (a *Anagent) step() {
+	if a.checkDeadline() || a.IsPaused() {
+		return
+	}
+
+	a.recordStep()
+	tick := atomic.AddUint64(&a.ticks, 1) - 1
+	// Pure scheduler usage skips the middleware stack,
+	// runAll checks again the handlers under the lock.
+	if atomic.LoadInt32(&a.handlersCount) > 0 {
+		a.runAll(tick)
+	}
+	if atomic.LoadInt32(&a.tickTasksCount) > 0 {
+		a.runTickTasks()
+	}
+	if atomic.LoadInt32(&a.pendingCount) > 0 {
+		a.Lock()
+		a.applyDurations()
+		a.Unlock()
+	}
+	a.detectClockJump()
+	a.checkUpcoming()
+
+	a.Lock()
+	scheduled, budget := a.scheduled(), a.stepBudget
+	a.Unlock()
+	if !scheduled {
+		return
+	}
+	if budget > 0 && a.drain(budget) > 0 {
+		return
+	}
+	a.consumeTimer(a.bestTimer())
+}
+
+// recordStep stores the timestamp of the Step in the ring
+// used to compute MeasuredTickRate.
+func (a *Anagent) recordStep() {
+	a.statsAccess.Lock()
+	defer a.statsAccess.Unlock()
+	a.steps[a.stepsCount%tickRateWindow] = time.Now()
+	a.stepsCount++
+}
+
+// MeasuredTickRate returns the average number of Steps per second,
+// computed over the last Steps executed.
+// It returns 0 if not enough Steps were executed yet.
+func (a *Anagent) MeasuredTickRate() float64 {
+	a.statsAccess.Lock()
+	defer a.statsAccess.Unlock()
+
+	n := a.stepsCount
+	if n > tickRateWindow {
+		n = tickRateWindow
+	}
+	if n < 2 {
+		return 0
+	}
+
+	last := a.steps[(a.stepsCount-1)%tickRateWindow]
+	first := a.steps[(a.stepsCount-n)%tickRateWindow]
+	elapsed := last.Sub(first).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(n-1) / elapsed
+}
+
+func (a *Anagent) consumeTimer(mintimeid *TimerID, mintime *time.Time) {
+	now := a.now()
+
+	if mintime.After(now) {
+		if a.BusyLoop {
+			return
+		}
+		if warning, ok := a.nextWarning(); ok && warning.Before(*mintime) {
+			a.sleep(warning.Sub(now))
+			return
+		}
+		if !a.sleep(mintime.Sub(now)) {
+			return
+		}
+	}
+
+	ready := a.ready()
+	a.Lock()
+	t, ok := a.timers[*mintimeid]
+	if !ok || t.paused {
+		a.Unlock()
+		return
+	}
+	if !ready && (!t.recurring || a.readinessPolicy == ReadinessHold) {
+		t.time = a.now().Add(readinessPoll)
+		a.Unlock()
+		return
+	}
+	if floor := t.floor(); a.now().Before(floor) {
+		t.time = floor
+		a.Unlock()
+		return
+	}
+	if t.window != nil && !t.window.contains(a.now()) && !t.recurring {
+		t.time = t.window.next(a.now())
+		a.Unlock()
+		return
+	}
+	active := ready && (t.window == nil || t.window.contains(a.now())) &&
+		!(t.recurring && a.now().Before(a.warmUntil))
+	when := t.when
+	a.Unlock()
+
+	var done <-chan struct{}
+	if active && (when == nil || a.allowed(when)) {
+		if t.then != nil {
+			defer a.thenOnPanic(*mintimeid, t)
+		}
+		done = a.fire(*mintimeid, t, false)
+	}
+
+	var then func(TimerID)
+	defer func() {
+		if then != nil {
+			a.runThen(*mintimeid, then, done)
+		}
+	}()
+	a.Lock()
+	defer a.Unlock()
+	a.applyDurations()
+	if t, ok = a.timers[*mintimeid]; !ok {
+		return
+	}
+	if t.base != "" {
+		a.rescheduleDependent(*mintimeid, t, a.now())
+	} else if t.recurring == true && (t.maxRuns <= 0 || t.runs < t.maxRuns) {
+		t.reschedule(a.now())
+		if floor := t.floor(); t.time.Before(floor) {
+			t.time = floor
+		}
+		a.rescheduleDependents(*mintimeid, t)
+	} else {
+		delete(a.timers, *mintimeid)
+		a.publish(TimerRemoved, *mintimeid)
+		then = t.then
+	}
+}
+
+// DrainDue fires, in order, all the timers that are due when it is called,
+// and returns how many were fired.
+// The due set is taken when the drain starts: timers created or rescheduled
+// by the handlers during the drain are deferred to the next Step,
+// even if they are already due, so a drain is always bounded.
+func (a *Anagent) DrainDue() int {
+	return a.drain(0)
+}
+
+// WarmUp suppresses the fires of the recurring timers during the first d
+// after Start: their schedules advance as usual, but their handlers are not
+// invoked until the warm-up is over. One-shot timers are not affected.
+func (a *Anagent) WarmUp(d time.Duration) {
+	a.Lock()
+	defer a.Unlock()
+	a.warmUp = d
+}
+
+// SetStepBudget makes each Step fire all the due timers, instead of one,
+// as long as the time spent in their handlers during the Step doesn't
+// exceed d: the remaining due timers are deferred to the next Step.
+// A zero duration restores firing one timer per Step.
+func (a *Anagent) SetStepBudget(d time.Duration) {
+	a.Lock()
+	defer a.Unlock()
+	a.stepBudget = d
+}
+
+// drain fires the due timers as described by DrainDue, stopping once the
+// time spent exceeds the budget, if greater than zero.
+func (a *Anagent) drain(budget time.Duration) int {
+	type due struct {
+		id    TimerID
+		at    time.Time
+		timer *Timer
+	}
+
+	now := a.now()
+	a.Lock()
+	set := []due{}
+	for id, t := range a.timers {
+		if !t.paused && !t.time.After(now) {
+			set = append(set, due{id, t.time, t})
+		}
+	}
+	sort.Slice(set, func(i, j int) bool {
+		return a.precedes(set[i].id, a.timers[set[i].id], set[j].id, a.timers[set[j].id])
+	})
+	a.Unlock()
+
+	fired := 0
+	for i := range set {
+		// skip the timers removed, paused or rescheduled meanwhile
+		a.Lock()
+		t, ok := a.timers[set[i].id]
+		ok = ok && t == set[i].timer && !t.paused && t.time.Equal(set[i].at)
+		a.Unlock()
+		if !ok {
+			continue
+		}
+		a.consumeTimer(&set[i].id, &set[i].at)
+		fired++
+		if budget > 0 && a.now().Sub(now) >= budget {
+			break
+		}
+	}
+	return fired
+}
+
+// fire invokes the timer handler. If its handler runs concurrently and
+// the timer has a completion callback or wait is true, it returns
+// a channel closed once the handler returned.
+func (a *Anagent) fire(id TimerID, t *Timer, wait bool) (done <-chan struct{}) {
+	a.Lock()
+	t.lastFire = a.now()
+	t.drift = t.lastFire.Sub(t.time)
+	t.runs++
+	t.running++
+	lock, values := t.lock, t.values
+	a.Unlock()
+
+	returned := func() {
+		a.Lock()
+		t.running--
+		a.Unlock()
+	}
+	if t.concurrent || a.Concurrent {
+		var finished chan struct{}
+		if t.then != nil || wait {
+			finished = make(chan struct{})
+			done = finished
+		}
+		a.invokeConcurrent(id, t.label, t.handler, lock, values, func() {
+			returned()
+			if finished != nil {
+				close(finished)
+			}
+		})
+	} else {
+		defer returned()
+		a.runPooled(func() { a.invokeTimer(id, t.label, t.handler, lock, values) })
+	}
+	a.publish(TimerFired, id)
+	a.record(Operation{Op: OpFire, TimerID: id})
+	return done
+}
+
+func (a *Anagent) bestTimer() (*TimerID, *time.Time) {
+	id, t, _ := a.EarliestTimer()
+	return &id, &t
+}
+
+// EarliestTimer returns the timer that is going to fire first, with
+// its scheduled time. It returns false if there are no timers.
+func (a *Anagent) EarliestTimer() (TimerID, time.Time, bool) {
+	a.Lock()
+	defer a.Unlock()
+	return a.scanTimers(a.precedes)
+}
+
+// OverdueCount returns how many timers are due but not fired yet.
+// A growing count signals that the loop can't keep up with its timers.
+func (a *Anagent) OverdueCount() int {
+	now := a.now()
+	a.Lock()
+	defer a.Unlock()
+
+	count := 0
+	for _, t := range a.timers {
+		if !t.paused && !t.time.After(now) {
+			count++
+		}
+	}
+	return count
+}
+
+// LatestTimer returns the timer that is scheduled furthest in the future,
+// with its scheduled time. It returns false if there are no timers.
+func (a *Anagent) LatestTimer() (TimerID, time.Time, bool) {
+	a.Lock()
+	defer a.Unlock()
+	return a.scanTimers(func(_ TimerID, t *Timer, _ TimerID, best *Timer) bool { return t.time.After(best.time) })
+}
+
+// scanTimers returns the timer preferred by better over all the others.
+// It must be called with the lock held.
+func (a *Anagent) scanTimers(better func(tid TimerID, t *Timer, bestid TimerID, best *Timer) bool) (TimerID, time.Time, bool) {
+	var bestid TimerID
+	var best *Timer
 	for timerid, t := range a.timers {
-		if t.time.Before(mintime) {
-			mintime = t.time
-			mintimeid = timerid
+		if t.paused {
+			continue
+		}
+		if best == nil || better(timerid, t, bestid, best) {
+			bestid, best = timerid, t
 		}
 	}
+	if best == nil {
+		return bestid, time.Time{}, false
+	}
+	return bestid, best.time, true
+}
+
+// TimerInfo describes a timer to the comparator set with SetTimerComparator.
+type TimerInfo struct {
+	ID        TimerID
+	Time      time.Time
+	After     time.Duration
+	Recurring bool
+	Label     string
+	Runs      int
+	MaxRuns   int
+	// Seq is the creation order of the timer
+	Seq uint64
+}
+
+// info returns the TimerInfo of the timer.
+func (t *Timer) info(id TimerID) TimerInfo {
+	return TimerInfo{ID: id, Time: t.time, After: t.after, Recurring: t.recurring,
+		Label: t.label, Runs: t.runs, MaxRuns: t.maxRuns, Seq: t.seq}
+}
 
-	return &mintimeid, &mintime
+// SetTimerComparator sets the order in which the timers are fired:
+// less reports whether the timer a has to fire before the timer b.
+// By default timers are ordered by time, then by creation order.
+// A comparator not ordering by Time first can make a timer wait for
+// another one scheduled later. It is called with the agent locked,
+// so it must not call the agent. A nil comparator restores the default.
+func (a *Anagent) SetTimerComparator(less func(a, b TimerInfo) bool) {
+	a.Lock()
+	defer a.Unlock()
+	a.comparator = less
+	a.interrupt()
+}
+
+// precedes reports whether the timer t fires before the timer u.
+// It must be called with the agent lock held.
+func (a *Anagent) precedes(tid TimerID, t *Timer, uid TimerID, u *Timer) bool {
+	if a.comparator != nil {
+		return a.comparator(t.info(tid), u.info(uid))
+	}
+	if !t.time.Equal(u.time) {
+		return t.time.Before(u.time)
+	}
+	return t.seq < u.seq
 }
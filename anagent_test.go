@@ -1,9 +1,16 @@
 package anagent
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"log"
 	"reflect"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -15,6 +22,26 @@ func TestNew(t *testing.T) {
 	}
 }
 
+func TestWithName(t *testing.T) {
+	if New().Name() != "" {
+		t.Errorf("Agents should be unnamed by default")
+	}
+
+	agent := NewWithOptions(WithName("worker"))
+	if agent.Name() != "worker" {
+		t.Errorf("Unexpected name: %s", agent.Name())
+	}
+
+	var buf bytes.Buffer
+	agent.Invoke(func(l *log.Logger) {
+		l.SetOutput(&buf)
+		l.Println("hello")
+	})
+	if !strings.HasPrefix(buf.String(), "[Anagent:worker] ") {
+		t.Errorf("Name isn't shown in the log output: %q", buf.String())
+	}
+}
+
 func TestEmitter(t *testing.T) {
 	agent := New()
 
@@ -69,6 +96,31 @@ func TestUse(t *testing.T) {
 	})
 }
 
+func TestSetMiddlewareEnabled(t *testing.T) {
+	agent := New()
+	agent.BusyLoop = true
+	handled, fired := 0, 0
+
+	agent.Use(func() { handled++ })
+	agent.Timer(TimerID("timer"), time.Now(), 0, true, func() { fired++ })
+
+	agent.SetMiddlewareEnabled(false)
+	if agent.MiddlewareEnabled() {
+		t.Errorf("Middleware should be disabled")
+	}
+	agent.Step()
+	agent.Step()
+	if handled != 0 || fired != 2 {
+		t.Errorf("Middleware ran while disabled: %d handled, %d fired", handled, fired)
+	}
+
+	agent.SetMiddlewareEnabled(true)
+	agent.Step()
+	if handled != 1 || fired != 3 {
+		t.Errorf("Middleware didn't run once re-enabled: %d handled, %d fired", handled, fired)
+	}
+}
+
 func TestAfter(t *testing.T) {
 	agent := New()
 	triggered := 0
@@ -88,7 +140,7 @@ func TestAfter(t *testing.T) {
 			t.Errorf("Timer was not set by the previous timer")
 		}
 		if triggered != 4 {
-			t.Errorf("Timer was fired in not expected order! " + strconv.Itoa(triggered))
+			t.Errorf("Timer was fired in not expected order! %s", strconv.Itoa(triggered))
 		}
 		a.Stop()
 	})
@@ -213,6 +265,51 @@ func TestOnce(t *testing.T) {
 	}
 }
 
+func TestEmitAfter(t *testing.T) {
+	start, clock, agent := manualAgent()
+	received := []string{}
+	var firedAt time.Time
+	agent.Emitter().On("delayed", func(s string, n int) {
+		received = append(received, s+strconv.Itoa(n))
+		firedAt = clock.Now()
+	})
+
+	args := []interface{}{"fired", 1}
+	agent.EmitAfter(50*time.Millisecond, "delayed", args...)
+	args[0] = "mutated"
+	cancelled := agent.EmitAfter(30*time.Millisecond, "delayed", "cancelled", 2)
+	agent.RemoveTimer(cancelled)
+
+	agent.Advance(150 * time.Millisecond)
+
+	if !reflect.DeepEqual(received, []string{"fired1"}) {
+		t.Errorf("Unexpected emissions: %v", received)
+	}
+	if d := firedAt.Sub(start); d != 50*time.Millisecond {
+		t.Errorf("Event wasn't emitted after the delay: %v", d)
+	}
+}
+
+func TestInvokeIsolated(t *testing.T) {
+	agent := New()
+	agent.Map(&TestTest{Test: "global"})
+
+	fired := false
+	_, err := agent.InvokeIsolated(func(te *TestTest, s string, a *Anagent) {
+		if te.Test != "global" || s != "scoped" {
+			t.Errorf("Unexpected injected values: %v %s", te, s)
+		}
+		fired = true
+	}, "scoped")
+	if err != nil || !fired {
+		t.Fatalf("Handler wasn't invoked: %v", err)
+	}
+
+	if _, err := agent.Invoke(func(s string) {}); err == nil {
+		t.Errorf("Isolated values leaked in the agent injector")
+	}
+}
+
 func TestEmitSync(t *testing.T) {
 	agent := New()
 	varr := &TestTest{Test: "Just Once?"}
@@ -273,6 +370,306 @@ func TestTimer(t *testing.T) {
 	}
 }
 
+func TestDedupeTimers(t *testing.T) {
+	agent := New()
+	agent.DedupeTimers = true
+	handler := func() {}
+
+	first := agent.AddRecurringTimerSeconds(int64(5), handler)
+	second := agent.AddRecurringTimerSeconds(int64(5), handler)
+	if first != second || len(agent.timers) != 1 {
+		t.Errorf("Duplicated timer was created: %s %s", first, second)
+	}
+
+	agent.AddRecurringTimerSeconds(int64(10), handler)
+	agent.AddTimerSeconds(int64(5), handler)
+	if len(agent.timers) != 3 {
+		t.Errorf("Timers with different interval or not recurring shouldn't be coalesced")
+	}
+}
+
+func TestDedupeTimersConcurrent(t *testing.T) {
+	agent := New()
+	agent.DedupeTimers = true
+	handler := func() {}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			agent.AddRecurringTimerSeconds(int64(5), handler)
+		}()
+	}
+	wg.Wait()
+	if len(agent.TimerIDs()) != 1 {
+		t.Errorf("Expected a single timer, got %d", len(agent.TimerIDs()))
+	}
+}
+
+func TestConcurrentTimer(t *testing.T) {
+	agent := New()
+	var slow, fast int32
+
+	id := agent.Timer(TimerID("slow"), time.Now(), 10*time.Second, true, func() {
+		atomic.AddInt32(&slow, 1)
+		time.Sleep(300 * time.Millisecond)
+	})
+	if !agent.SetConcurrent(id, true) {
+		t.Fatal("Timer should exist")
+	}
+	agent.Timer(TimerID("fast"), time.Now().Add(10*time.Millisecond), 20*time.Millisecond, true, func() {
+		atomic.AddInt32(&fast, 1)
+	})
+
+	agent.SetRunDeadline(time.Now().Add(200 * time.Millisecond))
+	agent.Start()
+
+	if atomic.LoadInt32(&slow) != 1 {
+		t.Errorf("Slow timer should have fired once")
+	}
+	if atomic.LoadInt32(&fast) < 5 {
+		t.Errorf("Loop was blocked by the concurrent timer: %d fires", fast)
+	}
+	if agent.SetConcurrent(TimerID("missing"), true) {
+		t.Errorf("SetConcurrent should fail on missing timers")
+	}
+}
+
+func TestConcurrentAgent(t *testing.T) {
+	agent := New()
+	agent.Concurrent = true
+	var slow, fast int32
+
+	agent.Timer(TimerID("slow"), time.Now(), 10*time.Second, true, func(a *Anagent) {
+		atomic.AddInt32(&slow, 1)
+		a.SafeMap(&TestTest{Test: "mapped"})
+		time.Sleep(300 * time.Millisecond)
+	})
+	agent.Timer(TimerID("fast"), time.Now().Add(10*time.Millisecond), 20*time.Millisecond, true, func(a *Anagent) {
+		atomic.AddInt32(&fast, 1)
+	})
+
+	agent.SetRunDeadline(time.Now().Add(200 * time.Millisecond))
+	agent.Start()
+
+	if atomic.LoadInt32(&slow) != 1 {
+		t.Errorf("Slow timer should have fired once")
+	}
+	if atomic.LoadInt32(&fast) < 5 {
+		t.Errorf("Loop was blocked by the slow handler: %d fires", fast)
+	}
+	if err := agent.AssertNoLeaks(time.Second); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	agent := New()
+	agent.SetMaxConcurrency(1)
+	var active, peak, done int32
+
+	for i := 0; i < 3; i++ {
+		id := agent.AddTimerSeconds(int64(0), func() {
+			if n := atomic.AddInt32(&active, 1); n > atomic.LoadInt32(&peak) {
+				atomic.StoreInt32(&peak, n)
+			}
+			time.Sleep(30 * time.Millisecond)
+			atomic.AddInt32(&active, -1)
+			atomic.AddInt32(&done, 1)
+		})
+		agent.SetConcurrent(id, true)
+	}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		agent.Step()
+	}
+	if time.Since(start) > 20*time.Millisecond {
+		t.Errorf("Loop waited for concurrent handlers")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if atomic.LoadInt32(&done) != 3 || atomic.LoadInt32(&peak) != 1 {
+		t.Errorf("Max concurrency wasn't respected: %d done, %d peak", done, peak)
+	}
+}
+
+func TestMeasuredTickRate(t *testing.T) {
+	agent := New()
+	if agent.MeasuredTickRate() != 0 {
+		t.Errorf("Tick rate should be 0 before running")
+	}
+
+	agent.Timer(TimerID("fast"), time.Now(), 10*time.Millisecond, true, func() {})
+	agent.SetRunDeadline(time.Now().Add(300 * time.Millisecond))
+	agent.Start()
+
+	rate := agent.MeasuredTickRate()
+	if rate < 50 || rate > 150 {
+		t.Errorf("Measured tick rate isn't plausible: %f", rate)
+	}
+}
+
+func TestFixedRate(t *testing.T) {
+	start, clock, agent := manualAgent()
+	fires := []time.Duration{}
+
+	id := agent.Timer(TimerID("fixed"), start.Add(100*time.Millisecond), 100*time.Millisecond, true, func() {
+		fires = append(fires, clock.Now().Sub(start))
+		clock.Add(40 * time.Millisecond)
+	})
+	agent.FixedRate(id, true)
+	agent.Advance(550 * time.Millisecond)
+
+	if len(fires) != 5 {
+		t.Fatalf("Expected 5 fires, got %v", fires)
+	}
+	for i, f := range fires {
+		if expected := time.Duration(i+1) * 100 * time.Millisecond; f != expected {
+			t.Errorf("Fire %d drifted: expected %v, got %v", i, expected, f)
+		}
+	}
+}
+
+func TestFixedRateSkipsMissed(t *testing.T) {
+	now := time.Date(2018, 8, 10, 12, 0, 0, 0, time.UTC)
+	timer := &Timer{time: now, after: 10 * time.Millisecond, recurring: true, fixedRate: true}
+	timer.reschedule(now.Add(35 * time.Millisecond))
+
+	if !timer.time.Equal(now.Add(40 * time.Millisecond)) {
+		t.Errorf("Missed slots weren't skipped: %v", timer.time.Sub(now))
+	}
+}
+
+func TestTimerRelativeTo(t *testing.T) {
+	agent := New()
+	start := time.Now()
+	baseFires, depFires := []time.Duration{}, []time.Duration{}
+
+	base := agent.Timer(TimerID("backup"), start.Add(100*time.Millisecond), 100*time.Millisecond, true, func() {
+		baseFires = append(baseFires, time.Since(start))
+	})
+	_, ok := agent.TimerRelativeTo(base, 30*time.Millisecond, func(a *Anagent) {
+		depFires = append(depFires, time.Since(start))
+		if len(depFires) == 4 {
+			a.Stop()
+		}
+	})
+	if !ok {
+		t.Fatal("Relative timer wasn't created")
+	}
+	if _, ok := agent.TimerRelativeTo(TimerID("missing"), time.Second, func() {}); ok {
+		t.Errorf("Relative timer to a missing base shouldn't be created")
+	}
+
+	agent.Start()
+
+	for i, d := range depFires {
+		offset := d - baseFires[i]
+		if offset < 25*time.Millisecond || offset > 45*time.Millisecond {
+			t.Errorf("Relative fire %d isn't in lockstep with its base: %v", i, offset)
+		}
+	}
+
+	agent.RemoveTimer(base)
+	agent.AddTimerSeconds(int64(1), func(a *Anagent) { a.Stop() })
+	agent.Start()
+	if len(depFires) != 5 || len(agent.timers) != 0 {
+		t.Errorf("Relative timer should be removed after its base: %d fires, %d timers", len(depFires), len(agent.timers))
+	}
+}
+
+func TestMinFireInterval(t *testing.T) {
+	start, clock, agent := manualAgent()
+	fires := []time.Duration{}
+	id := agent.Timer(TimerID("busy"), start, time.Millisecond, true, func() {
+		fires = append(fires, clock.Now().Sub(start))
+	})
+	if !agent.MinFireInterval(id, 100*time.Millisecond) {
+		t.Fatal("Timer should exist")
+	}
+
+	agent.Advance(450 * time.Millisecond)
+
+	expected := []time.Duration{0, 100, 200, 300, 400}
+	for i := range expected {
+		expected[i] *= time.Millisecond
+	}
+	if !reflect.DeepEqual(fires, expected) {
+		t.Errorf("Floor wasn't respected: expected fires at %v, got %v", expected, fires)
+	}
+}
+
+type testGate struct {
+	open bool
+}
+
+func TestFireWhen(t *testing.T) {
+	agent := New()
+	agent.BusyLoop = true
+	gate := &testGate{}
+	agent.Map(gate)
+	fired := 0
+
+	id := agent.Timer(TimerID("gated"), time.Now(), 0, true, func() { fired++ })
+	if !agent.FireWhen(id, func(g *testGate) bool { return g.open }) {
+		t.Fatal("Timer should exist")
+	}
+
+	agent.Step()
+	agent.Step()
+	if fired != 0 {
+		t.Errorf("Timer fired while the predicate was false")
+	}
+
+	gate.open = true
+	agent.Step()
+	agent.Step()
+	gate.open = false
+	agent.Step()
+	if fired != 2 {
+		t.Errorf("Timer should fire only while the predicate holds: %d", fired)
+	}
+	if agent.GetTimer(id) == nil {
+		t.Errorf("Skipped fires should keep the schedule")
+	}
+
+	assertPanic(t, func() {
+		agent.FireWhen(id, func() {})
+	})
+}
+
+func TestTriggerAll(t *testing.T) {
+	agent := New()
+	agent.BusyLoop = true
+	fired := map[int64]int{}
+	for _, seconds := range []int64{10, 20, 30} {
+		s := seconds
+		agent.AddRecurringTimerSeconds(s, func() { fired[s]++ })
+	}
+
+	agent.Step()
+	if len(fired) != 0 {
+		t.Fatalf("Timers fired before being triggered")
+	}
+
+	agent.TriggerAll()
+	for i := 0; i < 5; i++ {
+		agent.Step()
+	}
+	if !reflect.DeepEqual(fired, map[int64]int{10: 1, 20: 1, 30: 1}) {
+		t.Errorf("Triggered timers didn't fire once: %v", fired)
+	}
+
+	for _, timer := range agent.timers {
+		next := time.Until(timer.time)
+		if next < timer.after-time.Second || next > timer.after {
+			t.Errorf("Timer didn't resume its cadence: next fire in %v, interval %v", next, timer.after)
+		}
+	}
+}
+
 func TestNext(t *testing.T) {
 
 	agent := New()
@@ -303,21 +700,1465 @@ func TestNext(t *testing.T) {
 	}
 }
 
-func assertPanic(t *testing.T, f func()) {
-	defer func() {
-		if r := recover(); r == nil {
-			t.Errorf("The code did not panic")
-		}
+func TestUseEveryN(t *testing.T) {
+	agent := New()
+	ticks := []int{}
+	tick := 0
+
+	agent.Use(func() {
+		tick++
+	})
+	agent.UseEveryN(3, func() {
+		ticks = append(ticks, tick)
+	})
+
+	for i := 0; i < 10; i++ {
+		agent.Step()
+	}
+
+	if !reflect.DeepEqual(ticks, []int{1, 4, 7, 10}) {
+		t.Errorf("UseEveryN handler ran on unexpected ticks: %v", ticks)
+	}
+
+	assertPanic(t, func() {
+		agent.UseEveryN(0, func() {})
+	})
+}
+
+func TestReentrantStep(t *testing.T) {
+	agent := New()
+	var stepErr error
+	agent.On("reenter", func(a *Anagent) {
+		stepErr = a.TryStep()
+		a.Step()
+		a.Use(func() {})
+	})
+	agent.Use(func(a *Anagent) {
+		a.EmitSync("reenter")
+	})
+
+	done := make(chan bool)
+	go func() {
+		agent.Step()
+		done <- true
 	}()
-	f()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Reentering the agent from a listener deadlocked")
+	}
+
+	if stepErr != ErrReentrant {
+		t.Errorf("Expected ErrReentrant, got %v", stepErr)
+	}
+	if err := agent.TryStep(); err != nil {
+		t.Errorf("Step should be allowed once the previous one returned: %v", err)
+	}
 }
 
-func assertSleep(secSleep float64, t *testing.T, f func()) {
+func TestReentrantStepEmit(t *testing.T) {
+	agent := New()
+	var stepErr error
+	agent.On("reenter", func(a *Anagent) {
+		stepErr = a.TryStep()
+		a.Step()
+	})
+	agent.TimerSeconds(int64(0), false, func(a *Anagent) {
+		a.Emit("reenter")
+	})
+
+	done := make(chan bool)
+	go func() {
+		agent.Step()
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Reentering the agent from a listener of Emit deadlocked")
+	}
+	if stepErr != ErrReentrant {
+		t.Errorf("Expected ErrReentrant, got %v", stepErr)
+	}
+}
+
+func TestConcurrentSteps(t *testing.T) {
+	agent := New()
+	agent.AddRecurringTimerSeconds(int64(60), func() {})
+	done := make(chan struct{})
+	go func() {
+		agent.Start()
+		close(done)
+	}()
+	waitStarted(t, agent)
+
+	// the loop is waiting for the timer, the Step has to wake it up
+	stepped := make(chan error)
+	go func() { stepped <- agent.TryStep() }()
+	select {
+	case err := <-stepped:
+		if err != nil {
+			t.Errorf("Step from another goroutine was rejected: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Step from another goroutine didn't run")
+	}
+	agent.Stop()
+	<-done
+}
+
+func TestTicks(t *testing.T) {
+	agent := New()
+	for i := 0; i < 5; i++ {
+		agent.Step()
+	}
+	if agent.Ticks() != 5 {
+		t.Errorf("Expected 5 ticks, got %d", agent.Ticks())
+	}
+
+	agent.Use(func(a *Anagent) {
+		if a.Ticks() == 3 {
+			a.Stop()
+		}
+	})
+	agent.Start()
+	if agent.Ticks() != 3 {
+		t.Errorf("Ticks weren't reset on Start: %d", agent.Ticks())
+	}
+}
+
+func TestUsePriority(t *testing.T) {
+	agent := New()
+	order := []string{}
+
+	agent.UsePriority(10, func() { order = append(order, "last") })
+	agent.Use(func() { order = append(order, "default") })
+	agent.UsePriority(-5, func() { order = append(order, "first") })
+	agent.UsePriority(10, func() { order = append(order, "last-bis") })
+	agent.UsePriority(0, func() { order = append(order, "default-bis") })
+
+	agent.Step()
+
+	expected := []string{"first", "default", "default-bis", "last", "last-bis"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("Handlers executed in unexpected order: %v", order)
+	}
+}
+
+func TestStopInterruptsSleep(t *testing.T) {
+	agent := New()
+	fired := false
+	agent.AddTimerSeconds(int64(10), func() {
+		fired = true
+	})
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		agent.Stop()
+	}()
+
 	start := time.Now()
-	f()
-	sec := time.Since(start).Seconds()
+	agent.Start()
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Errorf("Start didn't return promptly after Stop: %v", elapsed)
+	}
+	if fired {
+		t.Errorf("Timer shouldn't have been fired")
+	}
+}
 
-	if sec < secSleep || sec > secSleep*1.05 {
-		t.Error("Timer wasn't fired in the specified time")
+func TestFlushNextOnStop(t *testing.T) {
+	agent := New()
+	agent.FlushNextOnStop(true)
+	fired := map[int]int{}
+
+	agent.AddRecurringTimerSeconds(int64(60), func() {})
+	agent.Use(func(a *Anagent) {
+		for i := 0; i < 3; i++ {
+			n := i
+			a.Next(func() { fired[n]++ })
+		}
+		a.Stop()
+	})
+
+	agent.Start()
+
+	if !reflect.DeepEqual(fired, map[int]int{0: 1, 1: 1, 2: 1}) {
+		t.Errorf("Pending Next handlers weren't flushed exactly once: %v", fired)
+	}
+	if len(agent.timers) != 1 {
+		t.Errorf("Recurring timers shouldn't be flushed")
+	}
+}
+
+func TestPause(t *testing.T) {
+	agent := New()
+	fired := make(chan bool, 1)
+	agent.Pause()
+	agent.AddTimerSeconds(int64(0), func(a *Anagent) {
+		fired <- true
+		a.Stop()
+	})
+
+	done := make(chan bool)
+	go func() {
+		agent.Start()
+		done <- true
+	}()
+
+	select {
+	case <-fired:
+		t.Fatal("Timer fired while the agent was paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	agent.Resume()
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		t.Fatal("Timer wasn't fired after resume")
+	}
+	<-done
+}
+
+func TestLifecycleHooks(t *testing.T) {
+	agent := New()
+	order := []string{}
+
+	agent.OnStart(func() { order = append(order, "start") })
+	agent.OnStop(func() { order = append(order, "stop") })
+	agent.AddTimerSeconds(int64(0), func(a *Anagent) {
+		order = append(order, "timer")
+		a.Stop()
+	})
+
+	agent.Start()
+	if !reflect.DeepEqual(order, []string{"start", "timer", "stop"}) {
+		t.Errorf("Hooks fired in unexpected order: %v", order)
+	}
+}
+
+func TestStartupTask(t *testing.T) {
+	agent := New()
+	order := []string{}
+
+	agent.StartupTask(3, func() { order = append(order, "third") })
+	agent.StartupTask(1, func() { order = append(order, "first") })
+	agent.StartupTask(2, func() { order = append(order, "second") })
+	agent.OnStart(func() { order = append(order, "onstart") })
+	agent.AddTimerSeconds(int64(0), func(a *Anagent) {
+		order = append(order, "timer")
+		a.Stop()
+	})
+
+	agent.Start()
+	expected := []string{"first", "second", "third", "onstart", "timer"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("Startup tasks ran in unexpected order: %v", order)
+	}
+
+	order = []string{}
+	agent.AddTimerSeconds(int64(0), func(a *Anagent) { a.Stop() })
+	agent.Start()
+	if !reflect.DeepEqual(order, []string{"onstart"}) {
+		t.Errorf("Startup tasks should run only once: %v", order)
+	}
+}
+
+func TestStartupTaskFatal(t *testing.T) {
+	agent := New()
+	agent.Fatal = true
+	fired := false
+
+	agent.StartupTask(1, func() error { return fmt.Errorf("not ready") })
+	agent.StartupTask(2, func() { fired = true })
+	agent.AddTimerSeconds(int64(0), func() { fired = true })
+
+	agent.Start()
+	if fired || agent.IsStarted() {
+		t.Errorf("Startup wasn't aborted")
+	}
+}
+
+func TestRunDeadline(t *testing.T) {
+	agent := New()
+	stopped := false
+	agent.OnStop(func() { stopped = true })
+	agent.AddRecurringTimerSeconds(int64(10), func() {})
+
+	agent.SetRunDeadline(time.Now().Add(time.Second))
+	agent.SetRunDeadline(time.Now().Add(300 * time.Millisecond))
+
+	start := time.Now()
+	agent.Start()
+	elapsed := time.Since(start)
+
+	if elapsed < 290*time.Millisecond || elapsed > 400*time.Millisecond {
+		t.Errorf("Loop didn't stop at the deadline: %v", elapsed)
+	}
+	if !stopped {
+		t.Errorf("OnStop hooks weren't fired")
+	}
+	if !agent.RunDeadline().IsZero() {
+		t.Errorf("Deadline should be cleared once reached")
+	}
+}
+
+func benchmarkStep(b *testing.B, handlers int) {
+	agent := New()
+	for i := 0; i < handlers; i++ {
+		agent.Use(func() {})
+	}
+	agent.Timer(TimerID("timer"), time.Now(), 0, true, func() {})
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		agent.Step()
+	}
+}
+
+func BenchmarkStepNoHandlers(b *testing.B) {
+	benchmarkStep(b, 0)
+}
+
+func BenchmarkStepOneHandler(b *testing.B) {
+	benchmarkStep(b, 1)
+}
+
+func assertPanic(t *testing.T, f func()) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("The code did not panic")
+		}
+	}()
+	f()
+}
+
+func assertSleep(secSleep float64, t *testing.T, f func()) {
+	start := time.Now()
+	f()
+	sec := time.Since(start).Seconds()
+
+	if sec < secSleep || sec > secSleep*1.05 {
+		t.Error("Timer wasn't fired in the specified time")
+	}
+}
+
+// manualAgent returns an agent driven by a ManualClock, the clock, and the
+// time the clock starts at.
+func manualAgent() (time.Time, *ManualClock, *Anagent) {
+	start := time.Date(2018, 8, 10, 12, 0, 0, 0, time.UTC)
+	clock := NewManualClock(start)
+	return start, clock, NewWithOptions(WithClock(clock))
+}
+
+func TestRunUntil(t *testing.T) {
+	agent := New()
+	fired := 0
+	agent.TimerSeconds(int64(0), true, func() { fired++ })
+
+	if !agent.RunUntil(func() bool { return fired >= 5 }, 5*time.Second) {
+		t.Fatal("RunUntil gave up before the predicate was satisfied")
+	}
+	if fired != 5 {
+		t.Errorf("Expected the predicate to be evaluated after each Step, fired %d times", fired)
+	}
+	if agent.IsStarted() {
+		t.Error("Agent still started after RunUntil")
+	}
+
+	if agent.RunUntil(func() bool { return false }, 50*time.Millisecond) {
+		t.Error("RunUntil reported success with a predicate never satisfied")
+	}
+}
+
+func TestDoubleStartPolicy(t *testing.T) {
+	start := func(policy DoubleStartPolicy) *Anagent {
+		agent := New()
+		agent.SetDoubleStartPolicy(policy)
+		agent.TimerSeconds(int64(1), true, func() {})
+		go agent.Start()
+		for !agent.IsStarted() {
+			time.Sleep(time.Millisecond)
+		}
+		return agent
+	}
+
+	agent := start(DoubleStartIgnore)
+	agent.Start()
+	if agent.StartErr() != nil {
+		t.Error("Ignore policy recorded an error")
+	}
+	agent.Stop()
+
+	agent = start(DoubleStartError)
+	if agent.StartErr() != nil {
+		t.Error("Error recorded before the second Start")
+	}
+	agent.Start()
+	if agent.StartErr() != ErrAlreadyStarted {
+		t.Errorf("Expected ErrAlreadyStarted, got %v", agent.StartErr())
+	}
+	agent.Stop()
+
+	agent = start(DoubleStartPanic)
+	assertPanic(t, agent.Start)
+	agent.Stop()
+}
+
+func TestEarliestLatestTimer(t *testing.T) {
+	agent := New()
+	if _, _, ok := agent.EarliestTimer(); ok {
+		t.Error("EarliestTimer reported a timer on an empty agent")
+	}
+	if _, _, ok := agent.LatestTimer(); ok {
+		t.Error("LatestTimer reported a timer on an empty agent")
+	}
+
+	agent.TimerSeconds(int64(5), false, func() {})
+	first := agent.TimerSeconds(int64(1), false, func() {})
+	last := agent.TimerSeconds(int64(60), false, func() {})
+	agent.TimerSeconds(int64(10), false, func() {})
+
+	id, at, ok := agent.EarliestTimer()
+	if !ok || id != first || !at.Equal(agent.GetTimer(first).time) {
+		t.Errorf("Unexpected earliest timer %v at %v", id, at)
+	}
+	id, at, ok = agent.LatestTimer()
+	if !ok || id != last || !at.Equal(agent.GetTimer(last).time) {
+		t.Errorf("Unexpected latest timer %v at %v", id, at)
+	}
+}
+
+func TestDrainDueDefersNewTimers(t *testing.T) {
+	agent := New()
+	order := []string{}
+	agent.TimerSeconds(int64(0), false, func() {
+		order = append(order, "first")
+		agent.TimerSeconds(int64(0), false, func() { order = append(order, "spawned") })
+	})
+	agent.TimerSeconds(int64(0), false, func() { order = append(order, "second") })
+
+	if n := agent.DrainDue(); n != 2 {
+		t.Errorf("Expected the drain to process the 2 due timers, processed %d", n)
+	}
+	if len(order) != 2 || order[0] == "spawned" || order[1] == "spawned" {
+		t.Errorf("Timer created during the drain ran in the same drain: %v", order)
+	}
+
+	agent.Step()
+	if len(order) != 3 || order[2] != "spawned" {
+		t.Errorf("Expected the spawned timer to run on the next Step: %v", order)
+	}
+}
+
+func TestDrainDueSkipsRescheduled(t *testing.T) {
+	start, _, agent := manualAgent()
+	fired := []string{}
+	agent.Timer(TimerID("a"), start.Add(-2*time.Second), 0, false, func() {
+		fired = append(fired, "a")
+		agent.Reconfigure(TimerID("b"), start.Add(time.Hour), 0, false)
+		agent.RemoveTimer(TimerID("c"))
+	})
+	agent.Timer(TimerID("b"), start.Add(-time.Second), 0, false, func() { fired = append(fired, "b") })
+	agent.Timer(TimerID("c"), start.Add(-time.Second), 0, false, func() { fired = append(fired, "c") })
+
+	if n := agent.DrainDue(); n != 1 || !reflect.DeepEqual(fired, []string{"a"}) {
+		t.Errorf("Expected the rescheduled and removed timers to be skipped, fired %d: %v", n, fired)
+	}
+	if agent.GetTimer(TimerID("b")) == nil {
+		t.Error("Rescheduled timer was consumed by the drain")
+	}
+}
+
+func TestMaxTimers(t *testing.T) {
+	agent := New()
+	agent.SetMaxTimers(2, TimersRejectNew)
+	first := agent.TimerSeconds(int64(10), false, func() {})
+	agent.TimerSeconds(int64(20), false, func() {})
+
+	id, err := agent.TimerErr(TimerID(""), time.Now().Add(time.Second), time.Second, false, func() {})
+	if err != ErrTooManyTimers || id != "" || len(agent.timers) != 2 {
+		t.Errorf("Expected the new timer to be rejected, got %q, %v", id, err)
+	}
+	if agent.TimerSeconds(int64(1), false, func() {}) != "" {
+		t.Error("Timer didn't return an empty TimerID for a rejected timer")
+	}
+	if _, err := agent.TimerErr(first, time.Now(), time.Second, false, func() {}); err != nil {
+		t.Errorf("Replacing an existing timer was rejected: %v", err)
+	}
+
+	agent = New()
+	agent.SetMaxTimers(2, TimersEvictFurthest)
+	near := agent.TimerSeconds(int64(10), false, func() {})
+	far := agent.TimerSeconds(int64(60), false, func() {})
+	added, err := agent.TimerErr(TimerID(""), time.Now().Add(30*time.Second), time.Second, false, func() {})
+	if err != nil {
+		t.Fatalf("Expected the new timer to be added, got %v", err)
+	}
+	if agent.GetTimer(far) != nil || agent.GetTimer(near) == nil || agent.GetTimer(added) == nil {
+		t.Error("Expected the furthest-out timer to be evicted")
+	}
+
+	if id, err := agent.TimerErr(TimerID(""), time.Now().Add(time.Minute), time.Second, false, func() {}); err != ErrTooManyTimers || id != "" {
+		t.Errorf("Expected the new furthest-out timer to be rejected, got %q, %v", id, err)
+	}
+	if agent.GetTimer(near) == nil || agent.GetTimer(added) == nil {
+		t.Error("A timer was evicted for a rejected one")
+	}
+
+	var buf bytes.Buffer
+	agent.Record(&buf)
+	agent.TimerErr(TimerID("nearest"), time.Now().Add(time.Second), time.Second, false, func() {})
+	agent.Record(nil)
+	if !strings.Contains(buf.String(), `{"op":"remove","time":`) || !strings.Contains(buf.String(), `"timer":"`+string(added)+`"`) {
+		t.Errorf("Eviction wasn't recorded: %s", buf.String())
+	}
+}
+
+func TestMaxTimersConcurrent(t *testing.T) {
+	agent := New()
+	agent.SetMaxTimers(5, TimersRejectNew)
+
+	var wg sync.WaitGroup
+	var added int32
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := agent.TimerErr(TimerID(""), time.Now().Add(time.Minute), time.Second, false, func() {}); err == nil {
+				atomic.AddInt32(&added, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if added != 5 || len(agent.TimerIDs()) != 5 {
+		t.Errorf("Expected 5 timers, added %d and got %d", added, len(agent.TimerIDs()))
+	}
+}
+
+func TestAfterTicks(t *testing.T) {
+	agent := New()
+	agent.BusyLoop = true
+	ranAt := []int{}
+	step := 0
+	agent.AfterTicks(3, func() { ranAt = append(ranAt, step) })
+	agent.AfterTicks(1, func() { ranAt = append(ranAt, step) })
+
+	for step = 1; step <= 5; step++ {
+		agent.Step()
+	}
+	if !reflect.DeepEqual(ranAt, []int{1, 3}) {
+		t.Errorf("Expected the handlers to run on the 1st and 3rd Step, ran at %v", ranAt)
+	}
+}
+
+func TestHookPanicPolicy(t *testing.T) {
+	var logged bytes.Buffer
+	agent := New()
+	agent.logger.SetOutput(&logged)
+	agent.SetHookPanicPolicy(HookPanicPropagate, HookPanicContinue)
+
+	ran := []string{}
+	agent.OnStart(func() { agent.Stop() })
+	agent.OnStop(func() { panic("teardown failed") })
+	agent.OnStop(func() { ran = append(ran, "second") })
+	agent.Start()
+
+	if !reflect.DeepEqual(ran, []string{"second"}) {
+		t.Errorf("Expected the remaining OnStop hooks to run: %v", ran)
+	}
+	if !strings.Contains(logged.String(), "teardown failed") {
+		t.Errorf("Expected the panic to be logged, got %q", logged.String())
+	}
+
+	agent = New()
+	agent.logger.SetOutput(&logged)
+	agent.SetHookPanicPolicy(HookPanicAbort, HookPanicPropagate)
+	ran = []string{}
+	agent.TimerSeconds(int64(0), true, func() { ran = append(ran, "timer") })
+	agent.OnStart(func() { panic("setup failed") })
+	agent.OnStart(func() { ran = append(ran, "start") })
+	agent.OnStop(func() { ran = append(ran, "stop") })
+	agent.Start()
+
+	if !reflect.DeepEqual(ran, []string{"stop"}) {
+		t.Errorf("Expected a panicking OnStart to abort the run: %v", ran)
+	}
+
+	agent = New()
+	agent.OnStop(func() { panic("teardown failed") })
+	agent.OnStart(func() { agent.Stop() })
+	assertPanic(t, agent.Start)
+}
+
+func TestTimersByLabelPrefix(t *testing.T) {
+	agent := New()
+	label := func(id TimerID, l string) TimerID {
+		agent.SetLabel(id, l)
+		return id
+	}
+	daily := label(agent.Timer(TimerID("b1"), time.Now(), time.Hour, true, func() {}), "backup-daily")
+	weekly := label(agent.Timer(TimerID("b2"), time.Now(), time.Hour, true, func() {}), "backup-weekly")
+	label(agent.Timer(TimerID("c1"), time.Now(), time.Hour, true, func() {}), "cleanup")
+	agent.Timer(TimerID("u1"), time.Now(), time.Hour, true, func() {})
+
+	if ids := agent.TimersByLabelPrefix("backup-"); !reflect.DeepEqual(ids, []TimerID{daily, weekly}) {
+		t.Errorf("Unexpected timers for the prefix: %v", ids)
+	}
+	if ids := agent.TimersByLabelPrefix("restore-"); len(ids) != 0 {
+		t.Errorf("Unexpected timers for an unused prefix: %v", ids)
+	}
+}
+
+func TestStepBudget(t *testing.T) {
+	_, clock, agent := manualAgent()
+	agent.SetStepBudget(50 * time.Millisecond)
+	fired := 0
+	for i := 0; i < 5; i++ {
+		agent.TimerSeconds(int64(0), false, func() {
+			fired++
+			clock.Add(30 * time.Millisecond)
+		})
+	}
+
+	expected := []int{2, 4, 5}
+	for i, e := range expected {
+		agent.Step()
+		if fired != e {
+			t.Errorf("Step %d: expected %d fires, got %d", i+1, e, fired)
+		}
+	}
+}
+
+func TestPausedTimersIdleLoop(t *testing.T) {
+	agent := New()
+	fired := make(chan struct{}, 1)
+	id := agent.TimerSeconds(int64(0), true, func() {
+		select {
+		case fired <- struct{}{}:
+		default:
+		}
+	})
+	agent.PauseTimer(id)
+	done := make(chan struct{})
+	go func() {
+		agent.Start()
+		close(done)
+	}()
+	waitStarted(t, agent)
+
+	time.Sleep(100 * time.Millisecond)
+	if ticks := agent.Ticks(); ticks > 10 {
+		t.Errorf("Loop spun while all the timers were paused: %d Steps", ticks)
+	}
+	agent.ResumeTimer(id)
+	select {
+	case <-fired:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Resumed timer didn't wake up the loop")
+	}
+	agent.Stop()
+	<-done
+}
+
+func TestPauseTimerFromHandler(t *testing.T) {
+	start, clock, agent := manualAgent()
+
+	fires := []time.Duration{}
+	var id TimerID
+	id = agent.TimerSeconds(int64(1), true, func() {
+		fires = append(fires, clock.Now().Sub(start))
+		if len(fires) == 2 {
+			if !agent.PauseTimer(id) {
+				t.Error("PauseTimer didn't find the timer")
+			}
+		}
+	})
+
+	agent.Advance(10 * time.Second)
+	if len(fires) != 2 {
+		t.Fatalf("Expected the timer to stop firing once paused, fires %v", fires)
+	}
+	if agent.OverdueCount() != 0 {
+		t.Error("Paused timer reported as overdue")
+	}
+
+	agent.ResumeTimer(id)
+	agent.Advance(3 * time.Second)
+	expected := []time.Duration{time.Second, 2 * time.Second, 11 * time.Second, 12 * time.Second, 13 * time.Second}
+	if !reflect.DeepEqual(fires, expected) {
+		t.Errorf("Expected fires at %v after resuming, got %v", expected, fires)
+	}
+
+	if agent.PauseTimer(TimerID("missing")) || agent.ResumeTimer(TimerID("missing")) {
+		t.Error("Pause and resume reported success for a missing timer")
+	}
+}
+
+func TestPausedTimerDoesNotBlock(t *testing.T) {
+	start, clock, agent := manualAgent()
+
+	paused := []time.Duration{}
+	id := agent.TimerSeconds(int64(1), true, func() { paused = append(paused, clock.Now().Sub(start)) })
+	other := 0
+	agent.TimerSeconds(int64(2), true, func() { other++ })
+
+	agent.PauseTimer(id)
+	agent.Advance(time.Minute)
+	if len(paused) != 0 || other != 30 {
+		t.Errorf("Expected only the other timer to fire, got %v and %d", paused, other)
+	}
+	if agent.GetTimer(id) == nil {
+		t.Error("Paused timer not found")
+	}
+
+	agent.ResumeTimer(id)
+	agent.Advance(2 * time.Second)
+	expected := []time.Duration{61 * time.Second, 62 * time.Second}
+	if !reflect.DeepEqual(paused, expected) {
+		t.Errorf("Expected fires at %v without catching up, got %v", expected, paused)
+	}
+}
+
+func TestSetTimerLock(t *testing.T) {
+	var shared sync.Mutex
+	var running, overlaps, fires int32
+
+	job := func() {
+		if atomic.AddInt32(&running, 1) > 1 {
+			atomic.AddInt32(&overlaps, 1)
+		}
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt32(&fires, 1)
+		atomic.AddInt32(&running, -1)
+	}
+
+	agents := []*Anagent{New(), New()}
+	for _, a := range agents {
+		id := a.TimerSeconds(int64(0), true, job)
+		if !a.SetTimerLock(id, &shared) {
+			t.Fatal("SetTimerLock didn't find the timer")
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, a := range agents {
+		wg.Add(1)
+		go func(a *Anagent) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				a.Step()
+			}
+		}(a)
+	}
+	wg.Wait()
+
+	if fires != 40 || overlaps != 0 {
+		t.Errorf("Expected 40 fires without overlaps, got %d fires and %d overlaps", fires, overlaps)
+	}
+}
+
+func TestWarmUp(t *testing.T) {
+	start, clock, agent := manualAgent()
+	agent.WarmUp(200 * time.Millisecond)
+
+	fires := []time.Duration{}
+	oneShot := time.Duration(-1)
+	agent.Timer(TimerID("poll"), start.Add(50*time.Millisecond), 50*time.Millisecond, true, func() {
+		fires = append(fires, clock.Now().Sub(start))
+	})
+	agent.Timer(TimerID("once"), start.Add(100*time.Millisecond), 0, false, func() {
+		oneShot = clock.Now().Sub(start)
+	})
+	agent.OnStart(func(a *Anagent) {
+		a.Advance(450 * time.Millisecond)
+		a.Stop()
+	})
+	agent.Start()
+
+	expected := []time.Duration{200, 250, 300, 350, 400, 450}
+	for i := range expected {
+		expected[i] *= time.Millisecond
+	}
+	if !reflect.DeepEqual(fires, expected) {
+		t.Errorf("Expected the recurring timer to fire only after the warm-up at %v, got %v", expected, fires)
+	}
+	if oneShot != 100*time.Millisecond {
+		t.Errorf("Expected the one-shot timer to fire during the warm-up, fired at %v", oneShot)
+	}
+}
+
+func namedTestHandler() {}
+
+func TestHandlerOrder(t *testing.T) {
+	agent := New()
+	ran := []string{}
+	agent.UseNamed("metrics", 10, func() { ran = append(ran, "metrics") })
+	agent.UseNamed("auth", -5, func() { ran = append(ran, "auth") })
+	agent.UseNamed("logging", 0, func() { ran = append(ran, "logging") })
+	agent.Use(namedTestHandler)
+	agent.UseNamed("recovery", -5, func() { ran = append(ran, "recovery") })
+
+	expected := []string{"auth", "recovery", "logging", "github.com/mudler/anagent.namedTestHandler", "metrics"}
+	if order := agent.HandlerOrder(); !reflect.DeepEqual(order, expected) {
+		t.Errorf("Unexpected handler order: %v", order)
+	}
+
+	agent.Step()
+	if !reflect.DeepEqual(ran, []string{"auth", "recovery", "logging", "metrics"}) {
+		t.Errorf("Reported order doesn't match the execution: %v", ran)
+	}
+}
+
+func TestStepThrough(t *testing.T) {
+	_, clock, agent := manualAgent()
+	agent.BusyLoop = true
+	agent.EnableStepThrough()
+	fired := make(chan struct{}, 10)
+	agent.TimerSeconds(int64(1), true, func() { fired <- struct{}{} })
+
+	done := make(chan struct{})
+	go func() {
+		agent.Start()
+		close(done)
+	}()
+
+	for i := 0; i < 3; i++ {
+		clock.Add(time.Second)
+		agent.StepThrough()
+		<-fired
+	}
+
+	agent.Stop()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Stop didn't release the loop waiting for StepThrough")
+	}
+	if ticks := agent.Ticks(); ticks != 3 || len(fired) != 0 {
+		t.Errorf("Expected 3 Steps, got %d and %d more fires", ticks, len(fired))
+	}
+}
+
+type contextKey string
+
+func TestSetTimerContext(t *testing.T) {
+	agent := New()
+	seen := map[string]interface{}{}
+	refresh := func(ctx context.Context) {
+		target := ctx.Value(contextKey("target")).(string)
+		seen[target] = ctx.Value(contextKey("retries"))
+	}
+
+	first := agent.TimerSeconds(int64(0), false, refresh)
+	second := agent.TimerSeconds(int64(0), false, refresh)
+	agent.SetTimerContext(first, contextKey("target"), "db")
+	agent.SetTimerContext(first, contextKey("retries"), 3)
+	agent.SetTimerContext(second, contextKey("target"), "cache")
+
+	agent.Step()
+	agent.Step()
+	if !reflect.DeepEqual(seen, map[string]interface{}{"db": 3, "cache": nil}) {
+		t.Errorf("Expected each fire to see its own values: %v", seen)
+	}
+	if agent.SetTimerContext(TimerID("missing"), contextKey("target"), "none") {
+		t.Error("SetTimerContext reported success for a missing timer")
+	}
+
+	var fallback context.Context
+	agent.TimerSeconds(int64(0), false, func(ctx context.Context) { fallback = ctx })
+	agent.Step()
+	if fallback != context.Background() {
+		t.Errorf("Expected context.Background() for a timer without values, got %v", fallback)
+	}
+}
+
+func TestSetIDGenerator(t *testing.T) {
+	agent := New()
+	first := agent.TimerSeconds(int64(1), false, func() {})
+	second := agent.TimerSeconds(int64(1), false, func() {})
+	if first == second || first != "1" || second != "2" {
+		t.Errorf("Expected the default generator to be a counter, got %q and %q", first, second)
+	}
+
+	n := 0
+	agent.SetIDGenerator(func() TimerID {
+		n++
+		return TimerID(fmt.Sprintf("job-%d", n))
+	})
+	agent.Timer(TimerID("job-2"), time.Now(), time.Second, false, func() {})
+	ids := []TimerID{}
+	for i := 0; i < 3; i++ {
+		ids = append(ids, agent.TimerSeconds(int64(1), false, func() {}))
+	}
+	if !reflect.DeepEqual(ids, []TimerID{"job-1", "job-3", "job-4"}) {
+		t.Errorf("Expected sequential IDs skipping the used ones, got %v", ids)
+	}
+}
+
+func TestInHandler(t *testing.T) {
+	agent := New()
+	var inMiddleware, inTimer, inOther, inOtherAgent bool
+	agent.Use(func() { inMiddleware = agent.InHandler() })
+	agent.TimerSeconds(int64(0), false, func() {
+		inTimer = agent.InHandler()
+		inOtherAgent = New().InHandler()
+		done := make(chan struct{})
+		go func() {
+			inOther = agent.InHandler()
+			close(done)
+		}()
+		<-done
+	})
+
+	if agent.InHandler() {
+		t.Error("InHandler reported true outside of the handlers")
+	}
+	agent.Step()
+	if !inMiddleware || !inTimer {
+		t.Errorf("InHandler reported false inside the handlers: middleware %v, timer %v", inMiddleware, inTimer)
+	}
+	if inOther || inOtherAgent {
+		t.Errorf("InHandler reported true on another goroutine %v, or for another agent %v", inOther, inOtherAgent)
+	}
+	if agent.InHandler() {
+		t.Error("InHandler reported true after the handlers")
+	}
+}
+
+func TestInHandlerOtherAgentBusy(t *testing.T) {
+	a, b := New(), New()
+	entered, release := make(chan struct{}), make(chan struct{})
+	b.TimerSeconds(int64(0), false, func() {
+		close(entered)
+		<-release
+	})
+	b.TimerSeconds(int64(0), false, func() {})
+	stepped := make(chan struct{})
+	go func() {
+		b.Step()
+		close(stepped)
+	}()
+	<-entered
+
+	var inOther bool
+	var stepErr error
+	a.TimerSeconds(int64(0), false, func() {
+		inOther = b.InHandler()
+		close(release)
+		stepErr = b.TryStep()
+	})
+	a.Step()
+	<-stepped
+	if inOther {
+		t.Error("InHandler reported true for another agent running a handler elsewhere")
+	}
+	if stepErr != nil {
+		t.Errorf("TryStep of another agent stepping elsewhere failed: %v", stepErr)
+	}
+}
+
+func TestSetDurationCoalesces(t *testing.T) {
+	agent := New()
+	agent.BusyLoop = true
+	id := agent.Timer(TimerID("poll"), time.Now(), time.Hour, true, func() {})
+
+	for i := 1; i <= 100; i++ {
+		agent.SetDuration(id, time.Duration(i)*time.Millisecond)
+	}
+	if n := len(agent.pendingDurations); n != 1 {
+		t.Errorf("Expected the changes to collapse in one, got %d", n)
+	}
+
+	before := time.Now()
+	agent.Step()
+	next := agent.GetTimer(id).time.Sub(before)
+	if agent.GetTimer(id).after != 100*time.Millisecond || next < 100*time.Millisecond || next > time.Second {
+		t.Errorf("Expected only the last duration to take effect, next fire in %v", next)
+	}
+}
+
+func TestSetDurationRemovedTimer(t *testing.T) {
+	agent := New()
+	id := agent.Timer(TimerID("t"), time.Now().Add(time.Minute), time.Minute, true, func() {})
+	agent.SetDuration(id, time.Second)
+	if !agent.Reconfigure(id, time.Now().Add(time.Hour), time.Hour, true) {
+		t.Fatal("Timer not found")
+	}
+	agent.Lock()
+	agent.applyDurations()
+	agent.Unlock()
+	if after := agent.GetTimer(id).after; after != time.Hour {
+		t.Errorf("Pending duration overrode Reconfigure: %v", after)
+	}
+
+	agent.SetDuration(id, time.Second)
+	agent.RemoveTimer(id)
+	agent.Timer(id, time.Now().Add(time.Minute), time.Minute, true, func() {})
+	agent.Lock()
+	agent.applyDurations()
+	agent.Unlock()
+	if after := agent.GetTimer(id).after; after != time.Minute {
+		t.Errorf("Pending duration of the removed timer applied to the new one: %v", after)
+	}
+}
+
+func TestSetDurationMissingTimer(t *testing.T) {
+	agent := New()
+	id := agent.AddRecurringTimerSeconds(int64(1), func() {})
+	if _, ok := agent.SetDuration(id, time.Second); !ok {
+		t.Error("SetDuration didn't find the timer")
+	}
+
+	agent.RemoveTimer(id)
+	if got, ok := agent.SetDuration(id, time.Second); ok || got != id {
+		t.Errorf("Expected SetDuration to report the removed timer, got %s %v", got, ok)
+	}
+	if after, ok := agent.pendingDurations[id]; ok {
+		t.Errorf("Expected no pending change for the removed timer, got %v", after)
+	}
+}
+
+func TestStopBeforeStart(t *testing.T) {
+	fired := 0
+	newAgent := func() *Anagent {
+		agent := New()
+		agent.AddRecurringTimerSeconds(int64(0), func() {
+			fired++
+			agent.Stop()
+		})
+		return agent
+	}
+	run := func(agent *Anagent) int {
+		fired = 0
+		agent.Start()
+		return fired
+	}
+
+	// By default Stop() before Start() has no effect
+	agent := newAgent()
+	agent.Stop()
+	if run(agent) != 1 {
+		t.Error("Expected the agent to run after a Stop() before Start()")
+	}
+
+	agent = newAgent()
+	agent.StopPreventsStart(true)
+	agent.Stop()
+	if run(agent) != 0 || agent.IsStarted() {
+		t.Error("Expected a Stop() before Start() to prevent the start")
+	}
+
+	agent.Reset()
+	if run(agent) != 1 {
+		t.Error("Expected the agent to run after Reset")
+	}
+
+	// A Stop() ending a run doesn't prevent the next one
+	if run(agent) != 1 {
+		t.Error("Expected the agent to run again after being stopped while started")
+	}
+}
+
+func TestTimerThen(t *testing.T) {
+	_, _, agent := manualAgent()
+
+	events := []string{}
+	var done TimerID
+	id := agent.TimerThen(time.Second, func() { events = append(events, "handler") }, func(id TimerID) {
+		if agent.GetTimer(id) != nil {
+			t.Error("Timer not removed before the completion callback")
+		}
+		done = id
+		events = append(events, "then")
+	})
+
+	agent.Advance(2 * time.Second)
+	if !reflect.DeepEqual(events, []string{"handler", "then"}) || done != id {
+		t.Errorf("Expected the callback after the handler for %s, got %v for %s", id, events, done)
+	}
+
+	called := false
+	agent.TimerThen(time.Second, func() { panic("boom") }, func(TimerID) { called = true })
+	assertPanic(t, func() { agent.Advance(2 * time.Second) })
+	if !called {
+		t.Error("Completion callback not invoked after a panicking handler")
+	}
+
+	called = false
+	skipped := agent.TimerThen(time.Second, func() { t.Error("Gated out handler fired") }, func(TimerID) { called = true })
+	agent.FireWhen(skipped, func() bool { return false })
+	agent.Advance(2 * time.Second)
+	if !called || agent.GetTimer(skipped) != nil {
+		t.Error("Completion callback not invoked for a skipped fire")
+	}
+
+	release := make(chan struct{})
+	finished := make(chan struct{})
+	handled := int32(0)
+	concurrent := agent.TimerThen(time.Second, func() {
+		<-release
+		atomic.StoreInt32(&handled, 1)
+	}, func(TimerID) {
+		if atomic.LoadInt32(&handled) != 1 {
+			t.Error("Completion callback invoked before the concurrent handler returned")
+		}
+		close(finished)
+	})
+	agent.SetConcurrent(concurrent, true)
+	agent.Advance(2 * time.Second)
+	close(release)
+	<-finished
+}
+
+func TestTimerMaxRuns(t *testing.T) {
+	start, clock, agent := manualAgent()
+
+	fires := []time.Duration{}
+	id := agent.TimerSeconds(int64(1), true, func() { fires = append(fires, clock.Now().Sub(start)) })
+	if !agent.TimerMaxRuns(id, 4) {
+		t.Fatal("TimerMaxRuns didn't find the timer")
+	}
+
+	agent.Advance(2 * time.Second)
+	if n := agent.TimerRuns(id); n != 2 {
+		t.Errorf("Expected 2 runs, got %d", n)
+	}
+	agent.SetDuration(id, 5*time.Second)
+	agent.Advance(time.Minute)
+
+	expected := []time.Duration{1 * time.Second, 2 * time.Second, 3 * time.Second, 8 * time.Second}
+	if !reflect.DeepEqual(fires, expected) {
+		t.Errorf("Expected fires at %v, got %v", expected, fires)
+	}
+	if agent.GetTimer(id) != nil {
+		t.Error("Timer not removed after its last run")
+	}
+	if agent.TimerMaxRuns(TimerID("missing"), 1) {
+		t.Error("TimerMaxRuns reported success for a missing timer")
+	}
+}
+
+func TestSetTimerComparator(t *testing.T) {
+	start, _, agent := manualAgent()
+
+	fired := []string{}
+	for _, label := range []string{"c", "a", "b"} {
+		label := label
+		id := agent.Timer(TimerID(""), start.Add(time.Second), 0, false, func() { fired = append(fired, label) })
+		agent.SetLabel(id, label)
+	}
+	agent.Timer(TimerID(""), start.Add(2*time.Second), 0, false, func() { fired = append(fired, "later") })
+
+	agent.Advance(time.Second)
+	if !reflect.DeepEqual(fired, []string{"c", "a", "b"}) {
+		t.Errorf("Expected same-time timers to fire in creation order, got %v", fired)
+	}
+
+	fired = fired[:0]
+	for _, label := range []string{"c", "a", "b"} {
+		label := label
+		id := agent.Timer(TimerID(""), start.Add(2*time.Second), 0, false, func() { fired = append(fired, label) })
+		agent.SetLabel(id, label)
+	}
+	agent.SetTimerComparator(func(a, b TimerInfo) bool {
+		if !a.Time.Equal(b.Time) {
+			return a.Time.Before(b.Time)
+		}
+		return a.Label < b.Label
+	})
+	agent.Advance(time.Second)
+	if !reflect.DeepEqual(fired, []string{"later", "a", "b", "c"}) {
+		t.Errorf("Expected the timers to fire ordered by label, got %v", fired)
+	}
+}
+
+func TestNextFire(t *testing.T) {
+	start, _, agent := manualAgent()
+
+	id := agent.TimerSeconds(int64(10), true, func() {})
+	if at, ok := agent.NextFire(id); !ok || !at.Equal(start.Add(10*time.Second)) {
+		t.Errorf("Unexpected next fire: %v %v", at, ok)
+	}
+	agent.Advance(10 * time.Second)
+	if at, _ := agent.NextFire(id); !at.Equal(start.Add(20 * time.Second)) {
+		t.Errorf("Next fire not updated after the fire: %v", at)
+	}
+	if _, ok := agent.NextFire(TimerID("missing")); ok {
+		t.Error("NextFire reported a missing timer")
+	}
+}
+
+func TestAssertNoLeaks(t *testing.T) {
+	agent := New()
+	agent.SetListenerTimeout(time.Millisecond)
+
+	release := make(chan struct{})
+	agent.On("slow", func() { <-release })
+	id := agent.TimerSeconds(int64(0), false, func() {
+		time.Sleep(20 * time.Millisecond)
+	})
+	agent.SetConcurrent(id, true)
+	agent.TimerSeconds(int64(0), false, func(a *Anagent) {
+		a.EmitSync("slow")
+		go a.StopAndWait()
+	})
+	agent.Start()
+
+	if err := agent.AssertNoLeaks(5 * time.Millisecond); err == nil {
+		t.Error("Expected the detached listener to be reported")
+	}
+	close(release)
+	if err := agent.AssertNoLeaks(time.Second); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAssertNoLeaksEmit(t *testing.T) {
+	agent := New()
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	agent.On("slow", func() { started <- struct{}{}; <-release })
+	agent.Once("slow", func() { started <- struct{}{}; <-release })
+	emitted := make(chan struct{})
+	go func() {
+		agent.Emit("slow")
+		close(emitted)
+	}()
+	<-started
+	<-started
+
+	if err := agent.AssertNoLeaks(5 * time.Millisecond); err == nil {
+		t.Error("Expected the running listeners to be reported")
+	}
+	close(release)
+	<-emitted
+	for i := 0; i < 10; i++ {
+		if err := agent.AssertNoLeaks(time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTimerIDs(t *testing.T) {
+	agent := New()
+	if ids := agent.TimerIDs(); len(ids) != 0 {
+		t.Errorf("Expected no timers, got %v", ids)
+	}
+	for _, id := range []string{"a", "b", "c", "d"} {
+		agent.Timer(TimerID(id), time.Now().Add(time.Hour), 0, false, func() {})
+	}
+
+	ids := agent.TimerIDs()
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if !reflect.DeepEqual(ids, []TimerID{"a", "b", "c", "d"}) {
+		t.Errorf("Unexpected timer IDs: %v", ids)
+	}
+
+	agent.RemoveTimers(ids[1:3]...)
+	agent.RemoveTimers("missing")
+	remaining := agent.TimerIDs()
+	sort.Slice(remaining, func(i, j int) bool { return remaining[i] < remaining[j] })
+	if !reflect.DeepEqual(remaining, []TimerID{"a", "d"}) {
+		t.Errorf("Unexpected timers after the removal: %v", remaining)
+	}
+	if len(ids) != 4 {
+		t.Error("The returned slice is not a copy")
+	}
+}
+
+func TestAtNextBoundary(t *testing.T) {
+	_, clock, agent := manualAgent()
+	clock.Add(37 * time.Millisecond)
+	start := clock.Now()
+
+	var firedAt time.Time
+	agent.AtNextBoundary(100*time.Millisecond, func() { firedAt = clock.Now() })
+	agent.Advance(time.Second)
+	if expected := start.Truncate(time.Second).Add(100 * time.Millisecond); !firedAt.Equal(expected) {
+		t.Errorf("Expected the timer to fire at %v, fired at %v", expected, firedAt)
+	}
+
+	agent.AtNextBoundary(time.Minute, func() { firedAt = clock.Now() })
+	agent.Advance(time.Minute)
+	if expected := time.Date(2018, 8, 10, 12, 1, 0, 0, time.UTC); !firedAt.Equal(expected) {
+		t.Errorf("Expected the timer to fire at %v, fired at %v", expected, firedAt)
+	}
+
+	assertPanic(t, func() { agent.AtNextBoundary(0, func() {}) })
+}
+
+func TestTimerAccessorsConcurrency(t *testing.T) {
+	agent := New()
+	agent.AddRecurringTimerSeconds(int64(0), func() {})
+	done := make(chan struct{})
+	go func() {
+		agent.Start()
+		close(done)
+	}()
+	waitStarted(t, agent)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				id := agent.Timer(TimerID(""), time.Now(), time.Millisecond, j%2 == 0, func() {})
+				agent.GetTimer(id)
+				agent.SetDuration(id, 2*time.Millisecond)
+				agent.RemoveTimer(id)
+			}
+		}()
+	}
+	wg.Wait()
+	agent.Stop()
+	<-done
+}
+
+func TestConcurrentStart(t *testing.T) {
+	agent := New()
+	var runs int32
+	agent.OnStart(func() { atomic.AddInt32(&runs, 1) })
+
+	returned := make(chan struct{}, 4)
+	for i := 0; i < 4; i++ {
+		go func() {
+			agent.Start()
+			returned <- struct{}{}
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		<-returned
+	}
+	agent.Stop()
+	<-returned
+
+	if n := atomic.LoadInt32(&runs); n != 1 {
+		t.Errorf("Expected the loop to be started once, started %d times", n)
+	}
+}
+
+func TestStartContext(t *testing.T) {
+	agent := New()
+	agent.AddTimerSeconds(int64(3600), func() {})
+	stopped := false
+	agent.OnStop(func() { stopped = true })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	agent.StartContext(ctx)
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Expected the loop to return on cancellation, returned after %v", elapsed)
+	}
+	if agent.IsStarted() || !stopped {
+		t.Error("Agent not stopped by the cancellation")
+	}
+
+	start = time.Now()
+	agent.StartContext(ctx)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected a cancelled context to stop the loop at once, returned after %v", elapsed)
+	}
+
+	fired := false
+	agent.AddTimerSeconds(int64(0), func(a *Anagent) {
+		fired = true
+		a.Stop()
+	})
+	agent.StartContext(context.Background())
+	if !fired {
+		t.Error("Timer not fired with a context that is never cancelled")
+	}
+}
+
+func TestStopAndDrain(t *testing.T) {
+	agent := New()
+	var oneShot, recurring, future int32
+	agent.Timer(TimerID("one"), time.Now().Add(-time.Second), 0, false, func() { atomic.AddInt32(&oneShot, 1) })
+	agent.Timer(TimerID("recurring"), time.Now().Add(-time.Second), time.Hour, true, func() { atomic.AddInt32(&recurring, 1) })
+	agent.AddTimerSeconds(int64(3600), func() { atomic.AddInt32(&future, 1) })
+
+	// the loop is not started: the due timers are fired at once
+	agent.StopAndDrain()
+	if oneShot != 1 || recurring != 1 || future != 0 {
+		t.Errorf("Expected the overdue timers to fire once, got %d %d %d", oneShot, recurring, future)
+	}
+	if agent.GetTimer("one") != nil || agent.GetTimer("recurring") == nil {
+		t.Error("Expected only the one-shot timer to be removed")
+	}
+
+	agent = New()
+	release := make(chan struct{})
+	agent.AddTimerSeconds(int64(0), func() { <-release })
+	agent.Timer(TimerID("one"), time.Now(), 0, false, func() { atomic.AddInt32(&oneShot, 1) })
+	agent.Timer(TimerID("recurring"), time.Now(), time.Hour, true, func() { atomic.AddInt32(&recurring, 1) })
+	go agent.Start()
+	waitStarted(t, agent)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(release)
+	}()
+	agent.StopAndDrain()
+	if atomic.LoadInt32(&oneShot) != 2 || atomic.LoadInt32(&recurring) != 2 {
+		t.Errorf("Expected the overdue timers to be drained on stop, got %d %d", oneShot, recurring)
+	}
+	if agent.IsStarted() {
+		t.Error("Agent still started after the drain")
+	}
+}
+
+func TestStopAndDrainConcurrent(t *testing.T) {
+	agent := New()
+	var fired int32
+	removed := false
+	agent.Timer(TimerID("one"), time.Now().Add(-time.Second), 0, false, func(a *Anagent) {
+		removed = a.GetTimer("one") == nil
+		atomic.AddInt32(&fired, 1)
+	})
+	agent.Timer(TimerID("other"), time.Now().Add(-time.Second), 0, false, func() {
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&fired, 1)
+	})
+	agent.SetConcurrent(TimerID("other"), true)
+
+	agent.StopAndDrain()
+	if atomic.LoadInt32(&fired) != 2 {
+		t.Errorf("Expected the drain to wait for the concurrent handlers, %d returned", fired)
+	}
+	if removed {
+		t.Error("One-shot timer removed before firing")
+	}
+	if agent.GetTimer("one") != nil || agent.GetTimer("other") != nil {
+		t.Error("Expected the one-shot timers to be removed once fired")
+	}
+}
+
+func TestTimerGeneratedIDConcurrency(t *testing.T) {
+	agent := New()
+	var n uint64
+	agent.SetIDGenerator(func() TimerID {
+		// two callers can get the same free ID
+		return TimerID(strconv.FormatUint(atomic.AddUint64(&n, 1)/2, 10))
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				agent.Timer(TimerID(""), time.Now().Add(time.Minute), 0, false, func() {})
+			}
+		}()
+	}
+	wg.Wait()
+	if len(agent.TimerIDs()) != 200 {
+		t.Errorf("Expected 200 timers, got %d", len(agent.TimerIDs()))
 	}
 }
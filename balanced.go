@@ -0,0 +1,66 @@
+// Copyright 2017-2018 Ettore Di Giacinto
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+// OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+// DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package anagent
+
+// balanced holds the listeners of an event dispatched with EmitBalanced,
+// and the rotation state.
+type balanced struct {
+	listeners []Handler
+	next      int
+}
+
+// OnBalanced binds a listener to an event dispatched with EmitBalanced.
+// Balanced listeners are not invoked by the other emission methods.
+// It panics if the listener is not a callable func.
+func (a *Anagent) OnBalanced(event, listener interface{}) *Anagent {
+	a.subsAccess.Lock()
+	defer a.subsAccess.Unlock()
+	if a.balanced == nil {
+		a.balanced = make(map[interface{}]*balanced)
+	}
+	b, ok := a.balanced[event]
+	if !ok {
+		b = &balanced{}
+		a.balanced[event] = b
+	}
+	b.listeners = append(b.listeners, validateAndWrapHandler(listener))
+	return a
+}
+
+// EmitBalanced dispatches the event with the arguments to exactly one
+// of the listeners bound with OnBalanced, chosen in round-robin.
+// It returns false if the event has no balanced listeners.
+func (a *Anagent) EmitBalanced(event interface{}, args ...interface{}) bool {
+	a.countEvent(event, 1, 0)
+	a.subsAccess.Lock()
+	b, ok := a.balanced[event]
+	if !ok || len(b.listeners) == 0 {
+		a.subsAccess.Unlock()
+		return false
+	}
+	listener := b.listeners[b.next%len(b.listeners)]
+	b.next = (b.next + 1) % len(b.listeners)
+	a.subsAccess.Unlock()
+
+	a.countEvent(event, 0, 1)
+	a.InvokeIsolated(listener, a.transform(event, args)...)
+	return true
+}
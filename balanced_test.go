@@ -0,0 +1,27 @@
+package anagent
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEmitBalanced(t *testing.T) {
+	agent := New()
+	received := make([][]int, 3)
+	for i := range received {
+		worker := i
+		agent.OnBalanced("job", func(n int) { received[worker] = append(received[worker], n) })
+	}
+
+	for n := 0; n < 6; n++ {
+		if !agent.EmitBalanced("job", n) {
+			t.Fatal("EmitBalanced found no listeners")
+		}
+	}
+	if !reflect.DeepEqual(received, [][]int{{0, 3}, {1, 4}, {2, 5}}) {
+		t.Errorf("Expected the jobs to be distributed in round-robin: %v", received)
+	}
+	if agent.EmitBalanced("missing") {
+		t.Error("EmitBalanced reported a dispatch without listeners")
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright 2017-2018 Ettore Di Giacinto
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+// OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+// DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package anagent
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	// nowFunc is the time source used for scheduling timers,
+	// it can be replaced in tests with setNowFunc to control time.
+	nowFunc   = time.Now
+	nowAccess sync.RWMutex
+)
+
+// timeNow returns the current time, as returned by nowFunc.
+func timeNow() time.Time {
+	nowAccess.RLock()
+	defer nowAccess.RUnlock()
+	return nowFunc()
+}
+
+// setNowFunc replaces the time source used for scheduling timers,
+// and returns a function that restores the previous one.
+func setNowFunc(f func() time.Time) func() {
+	nowAccess.Lock()
+	defer nowAccess.Unlock()
+
+	prev := nowFunc
+	nowFunc = f
+	return func() {
+		nowAccess.Lock()
+		defer nowAccess.Unlock()
+		nowFunc = prev
+	}
+}
+
+// Clock is a time source for the agent.
+type Clock interface {
+	Now() time.Time
+}
+
+// WithClock makes the agent schedule its timers with the supplied clock,
+// instead of the system one.
+func WithClock(c Clock) Option {
+	return func(a *Anagent) {
+		a.clock = c
+	}
+}
+
+// now returns the current time according to the agent clock.
+func (a *Anagent) now() time.Time {
+	if a.clock != nil {
+		return a.clock.Now()
+	}
+	return timeNow()
+}
+
+// ManualClock is a Clock that moves only when told to,
+// for deterministic tests of the scheduling.
+type ManualClock struct {
+	access sync.Mutex
+	now    time.Time
+}
+
+// NewManualClock returns a ManualClock set at the given time.
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start}
+}
+
+// Now returns the time of the clock.
+func (c *ManualClock) Now() time.Time {
+	c.access.Lock()
+	defer c.access.Unlock()
+	return c.now
+}
+
+// Set moves the clock to the given time.
+func (c *ManualClock) Set(t time.Time) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	c.now = t
+}
+
+// Add moves the clock forward by d.
+func (c *ManualClock) Add(d time.Duration) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Advance moves the ManualClock of the agent forward by d, firing in
+// chronological order every timer that becomes due meanwhile, without sleeping.
+// Recurring timers fire as many times as they are due, each fire being
+// rescheduled as the loop does it, while recurring timers with no interval
+// fire once.
+// It panics if the agent wasn't created with a ManualClock.
+func (a *Anagent) Advance(d time.Duration) {
+	clock, ok := a.clock.(*ManualClock)
+	if !ok {
+		panic("Anagent Advance requires a ManualClock")
+	}
+
+	target := clock.Now().Add(d)
+	once := map[TimerID]bool{}
+	for {
+		a.Lock()
+		var next TimerID
+		var at time.Time
+		found := false
+		for id, t := range a.timers {
+			if once[id] || t.paused || t.time.After(target) {
+				continue
+			}
+			if !found || a.precedes(id, t, next, a.timers[next]) {
+				next, at, found = id, t.time, true
+			}
+		}
+		if found && a.timers[next].recurring && a.timers[next].after <= 0 && a.timers[next].cron == nil {
+			once[next] = true
+		}
+		a.Unlock()
+
+		if !found {
+			break
+		}
+		if at.After(clock.Now()) {
+			clock.Set(at)
+		}
+		a.consumeTimer(&next, &at)
+	}
+	clock.Set(target)
+}
+
+// ClockJumpPolicy defines how the agent reacts to wall-clock jumps,
+// e.g. caused by NTP corrections or by the system waking up from sleep.
+type ClockJumpPolicy int
+
+const (
+	// ClockJumpIgnore leaves the timers untouched, overdue timers fire in a burst
+	ClockJumpIgnore ClockJumpPolicy = iota
+	// ClockJumpReanchor reschedules the recurring timers to now plus their interval
+	ClockJumpReanchor
+)
+
+// SetClockJumpPolicy sets the policy applied when the wall-clock jumps,
+// backward or forward, by more than threshold compared to the monotonic clock.
+// Jumps are not detected if the agent has a clock supplied with WithClock,
+// as its time is unrelated to the monotonic clock.
+func (a *Anagent) SetClockJumpPolicy(policy ClockJumpPolicy, threshold time.Duration) {
+	a.Lock()
+	defer a.Unlock()
+	a.jumpPolicy = policy
+	a.jumpThreshold = threshold
+}
+
+// detectClockJump compares the wall-clock with the monotonic one since the
+// last Step, and applies the clock jump policy if the wall-clock jumped.
+func (a *Anagent) detectClockJump() {
+	if a.clock != nil {
+		return
+	}
+	wall := a.now().Round(0)
+	mono := time.Now()
+
+	a.Lock()
+	defer a.Unlock()
+
+	prevWall, prevMono := a.lastWall, a.lastMono
+	a.lastWall, a.lastMono = wall, mono
+	if a.jumpPolicy == ClockJumpIgnore || prevWall.IsZero() {
+		return
+	}
+
+	drift := wall.Sub(prevWall.Add(mono.Sub(prevMono)))
+	if drift < 0 {
+		drift = -drift
+	}
+	if drift <= a.jumpThreshold {
+		return
+	}
+
+	for _, t := range a.timers {
+		if t.recurring {
+			t.time = wall.Add(t.after)
+			if t.cron != nil {
+				t.time = t.cron.next(wall)
+			}
+		}
+	}
+}
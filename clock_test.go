@@ -0,0 +1,259 @@
+package anagent
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a controllable time source for tests.
+type fakeClock struct {
+	sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2018, 8, 10, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Add(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestNowFunc(t *testing.T) {
+	clock := newFakeClock()
+	restore := setNowFunc(clock.Now)
+	defer restore()
+
+	agent := New()
+	agent.BusyLoop = true
+	fired := 0
+	agent.AddRecurringTimerSeconds(int64(10), func() { fired++ })
+
+	agent.Step()
+	clock.Add(9 * time.Second)
+	agent.Step()
+	if fired != 0 {
+		t.Errorf("Timer fired before its time")
+	}
+
+	clock.Add(time.Second)
+	agent.Step()
+	agent.Step()
+	if fired != 1 {
+		t.Errorf("Timer should have been fired once: %d", fired)
+	}
+
+	clock.Add(10 * time.Second)
+	agent.Step()
+	if fired != 2 {
+		t.Errorf("Recurring timer wasn't rescheduled with the fake clock: %d", fired)
+	}
+
+	restore()
+	if timeNow().Sub(clock.Now()) < time.Hour {
+		t.Errorf("Time source wasn't restored")
+	}
+}
+
+func TestClockJumpPolicy(t *testing.T) {
+	clock := newFakeClock()
+	restore := setNowFunc(clock.Now)
+	defer restore()
+
+	agent := New()
+	agent.BusyLoop = true
+	agent.SetClockJumpPolicy(ClockJumpReanchor, time.Minute)
+	fired := 0
+	for i := 0; i < 3; i++ {
+		agent.AddRecurringTimerSeconds(int64(1), func() { fired++ })
+	}
+
+	agent.Step()
+	clock.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		agent.Step()
+	}
+	if fired != 0 {
+		t.Errorf("Timers fired in a burst after the clock jump: %d", fired)
+	}
+
+	clock.Add(time.Second)
+	for i := 0; i < 3; i++ {
+		agent.Step()
+	}
+	if fired != 3 {
+		t.Errorf("Timers didn't resume their cadence after the jump: %d", fired)
+	}
+
+	agent.SetClockJumpPolicy(ClockJumpIgnore, time.Minute)
+	clock.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		agent.Step()
+	}
+	if fired != 6 {
+		t.Errorf("Timers should fire when jumps are ignored: %d", fired)
+	}
+}
+
+func TestClockJumpManualClock(t *testing.T) {
+	_, clock, agent := manualAgent()
+	agent.BusyLoop = true
+	agent.SetClockJumpPolicy(ClockJumpReanchor, time.Minute)
+	fired := 0
+	agent.AddRecurringTimerSeconds(int64(3600), func() { fired++ })
+
+	agent.Step()
+	clock.Add(time.Hour)
+	agent.Step()
+	if fired != 1 {
+		t.Errorf("Moving the injected clock was taken as a jump: %d fires", fired)
+	}
+}
+
+func TestOverdueCount(t *testing.T) {
+	clock := newFakeClock()
+	restore := setNowFunc(clock.Now)
+	defer restore()
+
+	agent := New()
+	agent.TimerSeconds(int64(1), true, func() {})
+	agent.TimerSeconds(int64(2), true, func() {})
+	agent.TimerSeconds(int64(60), true, func() {})
+	if n := agent.OverdueCount(); n != 0 {
+		t.Errorf("Expected no overdue timers, got %d", n)
+	}
+
+	// The loop is stalled: time passes without Steps
+	clock.Add(1500 * time.Millisecond)
+	if n := agent.OverdueCount(); n != 1 {
+		t.Errorf("Expected 1 overdue timer, got %d", n)
+	}
+	clock.Add(time.Second)
+	if n := agent.OverdueCount(); n != 2 {
+		t.Errorf("Expected 2 overdue timers, got %d", n)
+	}
+
+	agent.DrainDue()
+	if n := agent.OverdueCount(); n != 0 {
+		t.Errorf("Expected the drain to clear the backlog, got %d", n)
+	}
+}
+
+func TestAdvance(t *testing.T) {
+	start, clock, agent := manualAgent()
+
+	fires := []time.Duration{}
+	agent.TimerSeconds(int64(1), true, func() { fires = append(fires, clock.Now().Sub(start)) })
+	other := 0
+	agent.TimerSeconds(int64(4), false, func() { other++ })
+
+	agent.Advance(10 * time.Second)
+
+	if len(fires) != 10 {
+		t.Fatalf("Expected 10 fires, got %d: %v", len(fires), fires)
+	}
+	for i, f := range fires {
+		if f != time.Duration(i+1)*time.Second {
+			t.Errorf("Fire %d happened at %v", i, f)
+		}
+	}
+	if other != 1 {
+		t.Errorf("Expected the one-shot timer to fire once, fired %d", other)
+	}
+	if !clock.Now().Equal(start.Add(10 * time.Second)) {
+		t.Errorf("Clock not moved to the end of the interval: %v", clock.Now())
+	}
+
+	assertPanic(t, func() { New().Advance(time.Second) })
+}
+
+func TestReconfigure(t *testing.T) {
+	start, clock, agent := manualAgent()
+
+	fires := []time.Duration{}
+	id := agent.TimerSeconds(int64(10), true, func() { fires = append(fires, clock.Now().Sub(start)) })
+	agent.Advance(10 * time.Second)
+
+	if !agent.Reconfigure(id, clock.Now().Add(time.Second), 3*time.Second, true) {
+		t.Fatal("Reconfigure didn't find the timer")
+	}
+	agent.Advance(10 * time.Second)
+
+	expected := []time.Duration{10 * time.Second, 11 * time.Second, 14 * time.Second, 17 * time.Second, 20 * time.Second}
+	if !reflect.DeepEqual(fires, expected) {
+		t.Errorf("Expected fires at %v, got %v", expected, fires)
+	}
+
+	agent.Reconfigure(id, clock.Now().Add(time.Second), time.Second, false)
+	agent.Advance(10 * time.Second)
+	if len(fires) != 6 || agent.GetTimer(id) != nil {
+		t.Errorf("Expected the timer to fire once after becoming one-shot, fires %v", fires)
+	}
+
+	if agent.Reconfigure(TimerID("missing"), start, time.Second, true) {
+		t.Error("Reconfigure reported success for a missing timer")
+	}
+}
+
+func TestAdaptiveTimer(t *testing.T) {
+	start, clock, agent := manualAgent()
+
+	fires := []time.Duration{}
+	if _, err := agent.AdaptiveTimer(time.Second, 8*time.Second, 2, func() bool {
+		fires = append(fires, clock.Now().Sub(start))
+		return len(fires) == 5
+	}); err != nil {
+		t.Fatal(err)
+	}
+	agent.Advance(25 * time.Second)
+
+	expected := []time.Duration{1, 3, 7, 15, 23, 24}
+	for i := range expected {
+		expected[i] *= time.Second
+	}
+	if !reflect.DeepEqual(fires, expected) {
+		t.Errorf("Expected fires at %v, got %v", expected, fires)
+	}
+
+	assertPanic(t, func() { agent.AdaptiveTimer(time.Second, time.Minute, 2, func() {}) })
+	for _, args := range []struct {
+		base, max time.Duration
+		factor    float64
+	}{{0, time.Minute, 2}, {time.Second, time.Minute, 1}, {time.Minute, time.Second, 2}} {
+		if _, err := agent.AdaptiveTimer(args.base, args.max, args.factor, func() bool { return true }); err == nil {
+			t.Errorf("Expected an error for %+v", args)
+		}
+	}
+}
+
+func TestEmitEveryFunc(t *testing.T) {
+	_, _, agent := manualAgent()
+
+	counter := 0
+	received := []int{}
+	agent.On("metrics", func(n int, s string) { received = append(received, n) })
+	id := agent.EmitEveryFunc(time.Second, "metrics", func() []interface{} {
+		counter++
+		return []interface{}{counter, "requests"}
+	})
+
+	agent.Advance(3 * time.Second)
+	if !reflect.DeepEqual(received, []int{1, 2, 3}) {
+		t.Errorf("Expected fresh payloads on each emission, got %v", received)
+	}
+	agent.RemoveTimer(id)
+	agent.Advance(3 * time.Second)
+	if len(received) != 3 {
+		t.Errorf("Emissions didn't stop with the timer: %v", received)
+	}
+}
@@ -0,0 +1,109 @@
+package anagent
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	start := time.Date(2018, 8, 10, 12, 7, 30, 0, time.UTC)
+	for spec, expected := range map[string]time.Time{
+		"*/15 * * * *":     time.Date(2018, 8, 10, 12, 15, 0, 0, time.UTC),
+		"0 9 * * 1-5":      time.Date(2018, 8, 13, 9, 0, 0, 0, time.UTC),
+		"30 8,20 * * *":    time.Date(2018, 8, 10, 20, 30, 0, 0, time.UTC),
+		"0 0 1 jan *":      time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC),
+		"0 0 * * sun":      time.Date(2018, 8, 12, 0, 0, 0, 0, time.UTC),
+		"0 0 * * 7":        time.Date(2018, 8, 12, 0, 0, 0, 0, time.UTC),
+		"0 0 13 * 5":       time.Date(2018, 8, 13, 0, 0, 0, 0, time.UTC),
+		"10-20/5 12 * * *": time.Date(2018, 8, 10, 12, 10, 0, 0, time.UTC),
+	} {
+		c, err := parseCron(spec)
+		if err != nil {
+			t.Errorf("Unexpected error parsing %q: %v", spec, err)
+			continue
+		}
+		if next := c.next(start); !next.Equal(expected) {
+			t.Errorf("Expected %q to fire at %v, got %v", spec, expected, next)
+		}
+	}
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * * * 8", "5-1 * * * *", "*/0 * * * *", "a b c d e"} {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("Expected an error parsing %q", spec)
+		}
+	}
+}
+
+func TestCronTimer(t *testing.T) {
+	// Friday
+	_, clock, agent := manualAgent()
+
+	fires := []time.Time{}
+	id, err := agent.CronTimer(TimerID("standup"), "0 9 * * 1-5", func() { fires = append(fires, clock.Now()) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agent.GetTimer(id) == nil {
+		t.Fatal("Cron timer not found")
+	}
+
+	agent.Advance(4 * 24 * time.Hour)
+	expected := []time.Time{
+		time.Date(2018, 8, 13, 9, 0, 0, 0, time.UTC),
+		time.Date(2018, 8, 14, 9, 0, 0, 0, time.UTC),
+	}
+	if !reflect.DeepEqual(fires, expected) {
+		t.Errorf("Expected fires at %v, got %v", expected, fires)
+	}
+	if next := agent.GetTimer(id).time; !next.Equal(time.Date(2018, 8, 15, 9, 0, 0, 0, time.UTC)) {
+		t.Errorf("Next fire not computed from the expression: %v", next)
+	}
+
+	if _, err := agent.CronTimer(TimerID(""), "0 9 * *", func() {}); err == nil {
+		t.Error("Expected an error for an invalid expression")
+	}
+}
+
+func TestCronTimerDedupe(t *testing.T) {
+	_, clock, agent := manualAgent()
+	agent.DedupeTimers = true
+	handler := func() {}
+
+	plain := agent.Timer(TimerID(""), clock.Now(), 0, true, handler)
+	hourly, err := agent.CronTimer(TimerID(""), "0 * * * *", handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	daily, _ := agent.CronTimer(TimerID(""), "0 9 * * *", handler)
+	if hourly == plain || daily == hourly || len(agent.TimerIDs()) != 3 {
+		t.Fatalf("Cron timers were coalesced: %s %s %s", plain, hourly, daily)
+	}
+	if agent.GetTimer(plain).cron != nil {
+		t.Error("Cron schedule set on the coalesced timer")
+	}
+	if again := agent.Timer(TimerID(""), clock.Now(), 0, true, handler); again != plain {
+		t.Errorf("Expected the plain timer to be returned, got %s", again)
+	}
+}
+
+func TestCronTimerReplay(t *testing.T) {
+	_, clock, recorded := manualAgent()
+	var session bytes.Buffer
+	recorded.Record(&session)
+	recorded.CronTimer(TimerID("standup"), "0 9 * * 1-5", func() {})
+
+	agent := NewWithOptions(WithClock(clock))
+	err := agent.Replay(bytes.NewReader(session.Bytes()), func(op Operation) Handler { return func() {} })
+	if err != nil {
+		t.Fatal(err)
+	}
+	timer := agent.GetTimer(TimerID("standup"))
+	if timer == nil || timer.cron == nil || timer.cron.spec != "0 9 * * 1-5" {
+		t.Fatal("Cron timer not replayed")
+	}
+	if !timer.time.Equal(time.Date(2018, 8, 13, 9, 0, 0, 0, time.UTC)) {
+		t.Errorf("Replayed cron timer scheduled at %v", timer.time)
+	}
+}
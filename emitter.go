@@ -0,0 +1,315 @@
+// Copyright 2017-2018 Ettore Di Giacinto
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+// OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+// DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package anagent
+
+import (
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/chuckpreslar/emission"
+)
+
+// Emitter is the event emitter used by the agent.
+// By default the agent uses chuckpreslar/emission,
+// a different implementation can be supplied with WithEmitter.
+type Emitter interface {
+	// On binds the listener to the event
+	On(event, listener interface{})
+	// Once binds the listener to the event, it is fired only once
+	Once(event, listener interface{})
+	// Emit calls the event listeners with the arguments
+	Emit(event interface{}, arguments ...interface{})
+	// EmitSync calls the event listeners with the arguments, one after another
+	EmitSync(event interface{}, arguments ...interface{})
+	// RemoveListener unbinds the listener from the event
+	RemoveListener(event, listener interface{})
+	// GetListenerCount returns the number of listeners bound to the event
+	GetListenerCount(event interface{}) int
+}
+
+// emissionEmitter adapts *emission.Emitter to the Emitter interface.
+type emissionEmitter struct {
+	ee *emission.Emitter
+}
+
+func (e *emissionEmitter) On(event, listener interface{}) {
+	e.ee.On(event, listener)
+}
+
+func (e *emissionEmitter) Once(event, listener interface{}) {
+	e.ee.Once(event, listener)
+}
+
+func (e *emissionEmitter) Emit(event interface{}, arguments ...interface{}) {
+	e.ee.Emit(event, arguments...)
+}
+
+func (e *emissionEmitter) EmitSync(event interface{}, arguments ...interface{}) {
+	e.ee.EmitSync(event, arguments...)
+}
+
+func (e *emissionEmitter) RemoveListener(event, listener interface{}) {
+	e.ee.RemoveListener(event, listener)
+}
+
+func (e *emissionEmitter) GetListenerCount(event interface{}) int {
+	return e.ee.GetListenerCount(event)
+}
+
+// Bind binds the exported methods of obj named after the OnX convention
+// as listeners of the events named after them, with the first letter
+// lowercased: OnFoo is bound to the event "foo", OnFooBar to "fooBar".
+// The name must continue with an uppercase letter after On, so methods
+// like Online or Once are not bound.
+// The method arguments are injected like the ones of the listeners bound with On.
+// It returns the bound events.
+func (a *Anagent) Bind(obj interface{}) []string {
+	v := reflect.ValueOf(obj)
+	t := v.Type()
+
+	events := []string{}
+	for i := 0; i < t.NumMethod(); i++ {
+		name := t.Method(i).Name
+		if !strings.HasPrefix(name, "On") {
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(name[len("On"):])
+		if !unicode.IsUpper(r) {
+			continue
+		}
+		event := string(unicode.ToLower(r)) + name[len("On")+size:]
+		a.On(event, v.Method(i).Interface())
+		events = append(events, event)
+	}
+	return events
+}
+
+// OnUnhandled sets a fallback invoked with the event when
+// Emit or EmitSync find no listeners bound to it.
+// It is useful to spot missing wiring or to implement a default behavior.
+func (a *Anagent) OnUnhandled(fn func(event interface{})) {
+	a.subsAccess.Lock()
+	defer a.subsAccess.Unlock()
+	a.unhandled = fn
+}
+
+// handled reports whether the event has listeners, invoking
+// the OnUnhandled fallback when it has none.
+func (a *Anagent) handled(event interface{}) bool {
+	if a.EventEmitter().GetListenerCount(event) > 0 {
+		return true
+	}
+	a.subsAccess.Lock()
+	fn := a.unhandled
+	a.subsAccess.Unlock()
+	if fn != nil {
+		fn(event)
+	}
+	return false
+}
+
+// UseEventTransform registers a transform applied to the arguments
+// of the event before they are received by its listeners and subscriptions.
+// Multiple transforms of the same event are chained in registration order.
+// Transforms are applied for each listener, so they should have no side effects.
+func (a *Anagent) UseEventTransform(event interface{}, transform func(args []interface{}) []interface{}) {
+	a.subsAccess.Lock()
+	defer a.subsAccess.Unlock()
+	if a.transforms == nil {
+		a.transforms = make(map[interface{}][]func([]interface{}) []interface{})
+	}
+	a.transforms[event] = append(a.transforms[event], transform)
+}
+
+// transform applies the transforms of the event to a copy of its arguments.
+func (a *Anagent) transform(event interface{}, args []interface{}) []interface{} {
+	a.subsAccess.Lock()
+	transforms := a.transforms[event]
+	a.subsAccess.Unlock()
+
+	if len(transforms) == 0 {
+		return args
+	}
+	args = append([]interface{}{}, args...)
+	for _, t := range transforms {
+		args = t(args)
+	}
+	return args
+}
+
+// WithEmitter replaces the default emission emitter with the supplied one.
+// The emitter is mapped in the agent as Emitter.
+func WithEmitter(e Emitter) Option {
+	return func(a *Anagent) {
+		if def, ok := a.ee.(*emissionEmitter); ok {
+			a.Set(reflect.TypeOf(def.ee), reflect.Value{})
+		}
+		a.ee = e
+		a.MapTo(e, (*Emitter)(nil))
+	}
+}
+
+// SetListenerTimeout bounds the time each listener can take during EmitSync:
+// when a listener runs longer than d, a warning is logged and the emission
+// moves on to the next listener, while the slow one keeps running detached.
+// A zero duration, the default, waits for the listeners indefinitely.
+func (a *Anagent) SetListenerTimeout(d time.Duration) {
+	a.subsAccess.Lock()
+	defer a.subsAccess.Unlock()
+	a.timeout = d
+}
+
+// stopOnError carries the error of the failing listener of an event
+// emitted by EmitSyncStopOnError to the listeners bound after it.
+type stopOnError struct {
+	err error
+}
+
+// runStopOnError runs f, which emits an event with EmitSync, with stop
+// as the state of the emissions of the calling goroutine, so the listeners
+// invoked by it can find it. A nil stop hides the state of an outer
+// EmitSyncStopOnError from the listeners of a nested emission.
+func (a *Anagent) runStopOnError(stop *stopOnError, f func()) {
+	if stop == nil && atomic.LoadInt32(&a.stopsCount) == 0 {
+		f()
+		return
+	}
+	id := goroutineID()
+	a.stopsAccess.Lock()
+	if a.stops == nil {
+		a.stops = make(map[uint64]*stopOnError)
+	}
+	prev, nested := a.stops[id]
+	a.stops[id] = stop
+	if !nested {
+		atomic.AddInt32(&a.stopsCount, 1)
+	}
+	a.stopsAccess.Unlock()
+
+	defer func() {
+		a.stopsAccess.Lock()
+		if nested {
+			a.stops[id] = prev
+		} else {
+			delete(a.stops, id)
+			atomic.AddInt32(&a.stopsCount, -1)
+		}
+		a.stopsAccess.Unlock()
+	}()
+	f()
+}
+
+// stopState returns the state of the EmitSyncStopOnError
+// run by the calling goroutine, or nil if there is none.
+func (a *Anagent) stopState() *stopOnError {
+	if atomic.LoadInt32(&a.stopsCount) == 0 {
+		return nil
+	}
+	id := goroutineID()
+	a.stopsAccess.Lock()
+	defer a.stopsAccess.Unlock()
+	return a.stops[id]
+}
+
+// wrapListener returns the function bound to the emitter
+// for a listener bound with On or Once.
+func (a *Anagent) wrapListener(event, listener interface{}) func(...interface{}) {
+	return func(args ...interface{}) {
+		stop := a.stopState()
+		if stop != nil && stop.err != nil {
+			return
+		}
+		a.countEvent(event, 0, 1)
+		a.track(func() {
+			err := a.invokeListener(event, listener, a.transform(event, args))
+			if stop != nil {
+				stop.err = err
+			}
+		})
+	}
+}
+
+// invokeListener invokes the listener with the arguments of the event,
+// applying the listener timeout when it is called during an EmitSync,
+// and returns the error returned by the listener.
+// A panic of a listener that didn't time out is propagated to the caller.
+func (a *Anagent) invokeListener(event, listener interface{}, args []interface{}) error {
+	a.subsAccess.Lock()
+	d := a.timeout
+	a.subsAccess.Unlock()
+
+	invoke := func() error {
+		vals, err := a.InvokeIsolated(listener, args...)
+		if err != nil {
+			return err
+		}
+		return handlerError(vals)
+	}
+	if d <= 0 || !a.emittingSync() {
+		return invoke()
+	}
+
+	var err error
+	result := make(chan interface{}, 1)
+	a.spawn(func() {
+		defer func() { result <- recover() }()
+		err = invoke()
+	})
+
+	watchdog := time.NewTimer(d)
+	defer watchdog.Stop()
+	select {
+	case r := <-result:
+		if r != nil {
+			panic(r)
+		}
+		return err
+	case <-watchdog.C:
+		a.Log().Printf("listener of %v exceeded %v, continuing detached", event, d)
+		return nil
+	}
+}
+
+// emit emits the event with the EventEmitter. The listeners of
+// the events emitted by the running Step are run as part of it,
+// as Emit waits for them, so they can't wait for the Step.
+func (a *Anagent) emit(event interface{}, args ...interface{}) {
+	if a.stepping.contains() {
+		atomic.AddInt32(&a.stepEmits, 1)
+		defer atomic.AddInt32(&a.stepEmits, -1)
+	}
+	a.EventEmitter().Emit(event, args...)
+}
+
+// runSyncEmit runs f, which emits an event with EmitSync,
+// with the calling goroutine among the ones running an EmitSync.
+func (a *Anagent) runSyncEmit(f func()) {
+	a.syncEmitting.run(f)
+}
+
+// emittingSync returns true if the calling goroutine is running an EmitSync.
+func (a *Anagent) emittingSync() bool {
+	return a.syncEmitting.contains()
+}
@@ -0,0 +1,164 @@
+package anagent
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chuckpreslar/emission"
+)
+
+// fakeEmitter is a minimal synchronous Emitter recording its calls.
+type fakeEmitter struct {
+	listeners map[interface{}][]func(...interface{})
+	emitted   []interface{}
+}
+
+func (f *fakeEmitter) On(event, listener interface{}) {
+	f.listeners[event] = append(f.listeners[event], listener.(func(...interface{})))
+}
+
+func (f *fakeEmitter) Once(event, listener interface{}) {
+	f.On(event, listener)
+}
+
+func (f *fakeEmitter) Emit(event interface{}, arguments ...interface{}) {
+	f.emitted = append(f.emitted, event)
+	for _, l := range f.listeners[event] {
+		l(arguments...)
+	}
+}
+
+func (f *fakeEmitter) EmitSync(event interface{}, arguments ...interface{}) {
+	f.Emit(event, arguments...)
+}
+
+func (f *fakeEmitter) RemoveListener(event, listener interface{}) {}
+
+func (f *fakeEmitter) GetListenerCount(event interface{}) int {
+	return len(f.listeners[event])
+}
+
+func TestWithEmitter(t *testing.T) {
+	fake := &fakeEmitter{listeners: make(map[interface{}][]func(...interface{}))}
+	agent := NewWithOptions(WithEmitter(fake))
+	agent.Map(&TestTest{Test: "injected"})
+
+	received := ""
+	agent.On("test", func(te *TestTest, s string) {
+		received = te.Test + " " + s
+	})
+	if fake.GetListenerCount("test") != 1 {
+		t.Fatalf("Listener wasn't registered on the custom emitter")
+	}
+
+	if agent.Emitter() != nil {
+		t.Error("Emitter returned the default emitter with a custom one")
+	}
+	agent.EventEmitter().Emit("test", "payload")
+	agent.Emit("test")
+	if len(fake.emitted) != 2 || received != "injected payload" {
+		t.Errorf("Events weren't routed through the custom emitter: %v %q", fake.emitted, received)
+	}
+
+	if _, err := agent.Invoke(func(e Emitter) {
+		if e != fake {
+			t.Errorf("Custom emitter isn't mapped")
+		}
+	}); err != nil {
+		t.Error(err)
+	}
+	if _, err := agent.Invoke(func(e *emission.Emitter) {}); err == nil {
+		t.Errorf("Default emitter should not be mapped anymore")
+	}
+}
+
+func TestOnUnhandled(t *testing.T) {
+	agent := New()
+	var unhandled []interface{}
+	agent.OnUnhandled(func(event interface{}) { unhandled = append(unhandled, event) })
+
+	agent.EmitSync("missing")
+	agent.Emit("missing")
+	if !reflect.DeepEqual(unhandled, []interface{}{"missing", "missing"}) {
+		t.Errorf("Expected the fallback to receive the unhandled events, got %v", unhandled)
+	}
+
+	fired := false
+	agent.On("wired", func() { fired = true })
+	agent.EmitSync("wired")
+	if !fired || len(unhandled) != 2 {
+		t.Errorf("Fallback invoked for a handled event: %v", unhandled)
+	}
+}
+
+func TestUseEventTransform(t *testing.T) {
+	agent := New()
+	agent.UseEventTransform("legacy", func(args []interface{}) []interface{} {
+		return append(args, "enriched")
+	})
+	agent.UseEventTransform("legacy", func(args []interface{}) []interface{} {
+		return append(args, len(args))
+	})
+
+	var received []interface{}
+	agent.On("legacy", func(s string, n int) { received = []interface{}{s, n} })
+	agent.Emitter().EmitSync("legacy")
+
+	if !reflect.DeepEqual(received, []interface{}{"enriched", 1}) {
+		t.Errorf("Listener didn't receive the transformed arguments: %v", received)
+	}
+}
+
+type boundListener struct {
+	x      int
+	fooBar string
+}
+
+func (b *boundListener) OnX(n int)          { b.x = n }
+func (b *boundListener) OnFooBar(s string)  { b.fooBar = s }
+func (b *boundListener) Unrelated(s string) { panic("unexpected call") }
+func (b *boundListener) Online(s string)    { panic("unexpected call") }
+func (b *boundListener) Once(s string)      { panic("unexpected call") }
+func (b *boundListener) On(s string)        { panic("unexpected call") }
+
+func TestBind(t *testing.T) {
+	agent := New()
+	l := &boundListener{}
+	events := agent.Bind(l)
+	if !reflect.DeepEqual(events, []string{"fooBar", "x"}) {
+		t.Errorf("Unexpected bound events: %v", events)
+	}
+
+	agent.Emitter().EmitSync("x", 42)
+	agent.Emitter().EmitSync("fooBar", "bar")
+	if l.x != 42 || l.fooBar != "bar" {
+		t.Errorf("Bound methods not invoked: %+v", l)
+	}
+}
+
+func TestSetListenerTimeout(t *testing.T) {
+	logger := &fakeLogger{}
+	agent := NewWithOptions(WithLogger(logger))
+	agent.SetListenerTimeout(10 * time.Millisecond)
+
+	release := make(chan struct{})
+	defer close(release)
+	received := []string{}
+	agent.OnPriority("sync", 1, func() { received = append(received, "first") })
+	agent.OnPriority("sync", 2, func() { <-release })
+	agent.OnPriority("sync", 3, func() { received = append(received, "last") })
+
+	start := time.Now()
+	agent.EmitSync("sync")
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("EmitSync was blocked by the slow listener for %v", elapsed)
+	}
+	if !reflect.DeepEqual(received, []string{"first", "last"}) {
+		t.Errorf("Expected the other listeners to run, got %v", received)
+	}
+	if len(logger.lines) != 1 || !strings.Contains(logger.lines[0], "exceeded") {
+		t.Errorf("Expected a warning for the slow listener, got %v", logger.lines)
+	}
+}
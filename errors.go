@@ -0,0 +1,284 @@
+// Copyright 2017-2018 Ettore Di Giacinto
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+// OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+// DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package anagent
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/codegangsta/inject"
+)
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// CircuitOpenEvent is the event emitted, with the last error, when the
+// error circuit breaker set with SetErrorCircuitBreaker opens.
+const CircuitOpenEvent = "circuit.open"
+
+// MiddlewareErrorPolicy defines what happens to the rest of the middleware
+// stack of a tick when a middleware returns an error or panics.
+type MiddlewareErrorPolicy int
+
+const (
+	// MiddlewareAbort skips the remaining middlewares of the tick when one
+	// returns an error, panics are not recovered
+	MiddlewareAbort MiddlewareErrorPolicy = iota
+	// MiddlewareContinue recovers the panics of each middleware,
+	// and runs the remaining middlewares of the tick anyway
+	MiddlewareContinue
+)
+
+// SetMiddlewareErrorPolicy sets the policy applied when a middleware
+// returns an error or panics, by default it is MiddlewareAbort.
+func (a *Anagent) SetMiddlewareErrorPolicy(policy MiddlewareErrorPolicy) {
+	a.Lock()
+	defer a.Unlock()
+	a.middlewarePolicy = policy
+}
+
+// OnError sets the function receiving the errors returned by the middlewares
+// and by the timer handlers. If Fatal is set, the loop is also stopped.
+func (a *Anagent) OnError(fn func(error)) {
+	a.Lock()
+	defer a.Unlock()
+	a.errorHandler = fn
+}
+
+// OnPanic sets the function receiving the values of the panics recovered
+// from the middlewares with the MiddlewareContinue policy.
+// If it is not set, recovered panics are logged.
+func (a *Anagent) OnPanic(fn func(interface{})) {
+	a.Lock()
+	defer a.Unlock()
+	a.panicHandler = fn
+}
+
+// runMiddleware invokes a middleware handler applying the middleware
+// error policy, and returns false if the rest of the stack has to be skipped.
+func (a *Anagent) runMiddleware(handler Handler) (next bool) {
+	a.Lock()
+	policy, onError, onPanic := a.middlewarePolicy, a.errorHandler, a.panicHandler
+	a.Unlock()
+
+	if policy == MiddlewareContinue {
+		defer func() {
+			if r := recover(); r != nil {
+				if onPanic != nil {
+					onPanic(r)
+				} else {
+					a.Log().Printf("recovered middleware panic: %v", r)
+				}
+				next = true
+			}
+		}()
+	}
+
+	var err error
+	a.runPooled(func() {
+		a.runHandler(func() {
+			if a.RecoverPanics {
+				defer a.recoverPanic(&err)
+			}
+			err = a.invokeProfiled(a.Injector, "", handler)
+		})
+	})
+	a.circuitResult(err)
+	a.handlerError(err, onError)
+	return err == nil || policy == MiddlewareContinue
+}
+
+// runTask invokes a handler run by the loop outside of the middleware
+// stack and of the timers, e.g. with AfterTicks, recovering its panics
+// with RecoverPanics and routing its error to the OnError function.
+func (a *Anagent) runTask(handler Handler) {
+	a.Lock()
+	onError := a.errorHandler
+	a.Unlock()
+
+	var err error
+	a.runPooled(func() {
+		a.runHandler(func() {
+			if a.RecoverPanics {
+				defer a.recoverPanic(&err)
+			}
+			err = a.invokeProfiled(a.Injector, "", handler)
+		})
+	})
+	a.circuitResult(err)
+	a.handlerError(err, onError)
+}
+
+// handlerError routes the error returned by a handler to the OnError
+// function, and stops the loop if Fatal is set.
+func (a *Anagent) handlerError(err error, onError func(error)) {
+	if err == nil {
+		return
+	}
+	if onError != nil {
+		onError(err)
+	}
+	if a.Fatal {
+		a.Lock()
+		if a.fatalErr == nil {
+			a.fatalErr = err
+		}
+		a.Unlock()
+		a.Stop()
+	}
+}
+
+// recoverPanic recovers the panic of a handler, turning it into an error.
+// It must be deferred directly.
+func (a *Anagent) recoverPanic(err *error) {
+	if r := recover(); r != nil {
+		*err = fmt.Errorf("recovered handler panic: %v", r)
+	}
+}
+
+// invoke invokes the handler with the agent injector, and returns
+// the error returned by the handler, if its last return value is an error.
+// An error is returned also if the injection fails.
+func (a *Anagent) invoke(handler Handler) error {
+	return a.invokeIn(a.Injector, handler)
+}
+
+// invokeIn is like invoke, with the supplied injector.
+func (a *Anagent) invokeIn(inj inject.Injector, handler Handler) error {
+	vals, err := a.call(inj, handler)
+	if err != nil {
+		return err
+	}
+	return handlerError(vals)
+}
+
+// handlerError extracts the error from the values returned by a handler.
+func handlerError(vals []reflect.Value) error {
+	if len(vals) == 0 {
+		return nil
+	}
+
+	last := vals[len(vals)-1]
+	if last.Type() != errorType || last.IsNil() {
+		return nil
+	}
+	return last.Interface().(error)
+}
+
+// SetFailureEvent sets the event that is emitted when a timer handler
+// returns an error threshold times consecutively.
+// The event is emitted with the TimerID and the last error as arguments,
+// so listeners registered with On can receive them by injection.
+// The counter of a timer is reset when its handler succeeds.
+// A threshold lower than 1 disables the event.
+func (a *Anagent) SetFailureEvent(threshold int, event interface{}) {
+	a.Lock()
+	defer a.Unlock()
+	a.failureThreshold = threshold
+	a.failureEvent = event
+}
+
+// timerResult records the result and the duration of a timer handler
+// execution, emitting the failure event if the timer is failing.
+func (a *Anagent) timerResult(id TimerID, err error, elapsed time.Duration) {
+	a.circuitResult(err)
+
+	a.Lock()
+	onError := a.errorHandler
+	notify := false
+	event := a.failureEvent
+	if t, ok := a.timers[id]; ok {
+		t.busy += elapsed
+		t.completed++
+		t.lastErr = err
+		if err == nil {
+			t.failures = 0
+		} else {
+			t.failures++
+			notify = a.failureThreshold > 0 && t.failures == a.failureThreshold
+		}
+	}
+	a.Unlock()
+
+	a.handlerError(err, onError)
+	if notify {
+		a.emit(event, id, err)
+	}
+}
+
+// LastError returns the error returned by the last execution of the timer
+// handler, nil if it succeeded. It returns false if the timer does not exist.
+func (a *Anagent) LastError(id TimerID) (error, bool) {
+	a.Lock()
+	defer a.Unlock()
+	t, ok := a.timers[id]
+	if !ok {
+		return nil, false
+	}
+	return t.lastErr, true
+}
+
+// ClearError clears the last error of the timer.
+// It returns false if the timer does not exist.
+func (a *Anagent) ClearError(id TimerID) bool {
+	a.Lock()
+	defer a.Unlock()
+	t, ok := a.timers[id]
+	if !ok {
+		return false
+	}
+	t.lastErr = nil
+	return true
+}
+
+// SetErrorCircuitBreaker makes the agent pause when its timer and middleware
+// handlers return an error threshold times consecutively, emitting
+// CircuitOpenEvent with the last error. The agent keeps paused until Resume
+// is called. Any successful handler resets the count, and a threshold
+// lower than 1 disables the breaker.
+func (a *Anagent) SetErrorCircuitBreaker(threshold int) {
+	a.Lock()
+	defer a.Unlock()
+	a.breakerThreshold = threshold
+	a.breakerErrors = 0
+}
+
+// circuitResult records the result of a handler for the circuit breaker,
+// opening it when the errors reach the threshold.
+func (a *Anagent) circuitResult(err error) {
+	a.Lock()
+	if err == nil || a.breakerThreshold < 1 {
+		a.breakerErrors = 0
+		a.Unlock()
+		return
+	}
+	a.breakerErrors++
+	open := a.breakerErrors >= a.breakerThreshold
+	if open {
+		a.breakerErrors = 0
+	}
+	a.Unlock()
+
+	if open {
+		a.Pause()
+		a.emit(CircuitOpenEvent, err)
+	}
+}
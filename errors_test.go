@@ -0,0 +1,265 @@
+package anagent
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFailureEvent(t *testing.T) {
+	agent := New()
+	agent.BusyLoop = true
+	agent.SetFailureEvent(3, "timer.failing")
+
+	failing := true
+	fires := 0
+	id := agent.Timer(TimerID("failing"), time.Now(), 0, true, func() error {
+		fires++
+		if failing {
+			return errors.New("boom")
+		}
+		return nil
+	})
+
+	notified := 0
+	agent.On("timer.failing", func(tid TimerID, err error) {
+		if tid != id || err.Error() != "boom" {
+			t.Errorf("Unexpected payload: %s %v", tid, err)
+		}
+		notified++
+	})
+
+	for i := 0; i < 2; i++ {
+		agent.Step()
+	}
+	if notified != 0 {
+		t.Errorf("Event fired before the threshold")
+	}
+
+	for i := 0; i < 3; i++ {
+		agent.Step()
+	}
+	if fires != 5 || notified != 1 {
+		t.Errorf("Event should fire once the threshold is reached: %d fires, %d events", fires, notified)
+	}
+
+	failing = false
+	agent.Step()
+	failing = true
+	for i := 0; i < 3; i++ {
+		agent.Step()
+	}
+	if notified != 2 {
+		t.Errorf("Counter wasn't reset on success: %d events", notified)
+	}
+}
+
+func TestMiddlewareErrorPolicy(t *testing.T) {
+	run := func(policy MiddlewareErrorPolicy, failing Handler) (bool, []error, []interface{}) {
+		agent := New()
+		var errs []error
+		var panics []interface{}
+		agent.OnError(func(err error) { errs = append(errs, err) })
+		agent.OnPanic(func(r interface{}) { panics = append(panics, r) })
+		agent.SetMiddlewareErrorPolicy(policy)
+
+		last := false
+		agent.Use(func() {})
+		agent.Use(failing)
+		agent.Use(func() { last = true })
+		agent.Step()
+		return last, errs, panics
+	}
+
+	failing := func() error { return errors.New("boom") }
+	panicking := func() { panic("boom") }
+
+	last, errs, _ := run(MiddlewareContinue, failing)
+	if !last || len(errs) != 1 {
+		t.Errorf("Continue: expected the last middleware to run and the error to be routed, ran %v, errors %v", last, errs)
+	}
+	last, _, panics := run(MiddlewareContinue, panicking)
+	if !last || len(panics) != 1 || panics[0] != "boom" {
+		t.Errorf("Continue: expected the last middleware to run and the panic to be routed, ran %v, panics %v", last, panics)
+	}
+
+	last, errs, _ = run(MiddlewareAbort, failing)
+	if last || len(errs) != 1 {
+		t.Errorf("Abort: expected the last middleware to be skipped, ran %v, errors %v", last, errs)
+	}
+	assertPanic(t, func() { run(MiddlewareAbort, panicking) })
+}
+
+func TestErrorCircuitBreaker(t *testing.T) {
+	agent := New()
+	agent.SetErrorCircuitBreaker(3)
+	var opened []error
+	agent.On(CircuitOpenEvent, func(err error) { opened = append(opened, err) })
+
+	fires := 0
+	agent.TimerSeconds(int64(0), true, func() error {
+		fires++
+		return errors.New("downstream unavailable")
+	})
+
+	for i := 0; i < 5; i++ {
+		agent.Step()
+	}
+	if fires != 3 {
+		t.Errorf("Expected the breaker to stop the fires after 3 errors, fired %d", fires)
+	}
+	if !agent.IsPaused() || len(opened) != 1 || opened[0].Error() != "downstream unavailable" {
+		t.Errorf("Expected the breaker to pause the agent and emit the error, paused %v, events %v", agent.IsPaused(), opened)
+	}
+
+	agent.Resume()
+	agent.Step()
+	if fires != 4 || agent.IsPaused() {
+		t.Errorf("Expected the agent to run again after Resume, fired %d", fires)
+	}
+}
+
+func TestLastError(t *testing.T) {
+	agent := New()
+	fail := true
+	id := agent.TimerSeconds(int64(0), true, func() error {
+		if fail {
+			return errors.New("unreachable")
+		}
+		return nil
+	})
+
+	if err, ok := agent.LastError(id); !ok || err != nil {
+		t.Errorf("Expected no error before the first fire, got %v, %v", err, ok)
+	}
+	agent.Step()
+	if err, _ := agent.LastError(id); err == nil || err.Error() != "unreachable" {
+		t.Errorf("Expected the handler error, got %v", err)
+	}
+	if !agent.ClearError(id) {
+		t.Error("ClearError didn't find the timer")
+	}
+	if err, _ := agent.LastError(id); err != nil {
+		t.Errorf("Expected the error to be cleared, got %v", err)
+	}
+
+	agent.Step()
+	fail = false
+	agent.Step()
+	if err, _ := agent.LastError(id); err != nil {
+		t.Errorf("Expected a success to clear the error, got %v", err)
+	}
+
+	if _, ok := agent.LastError(TimerID("missing")); ok || agent.ClearError(TimerID("missing")) {
+		t.Error("LastError and ClearError reported a missing timer")
+	}
+}
+
+func TestTimerOnError(t *testing.T) {
+	agent := New()
+	received := []error{}
+	agent.OnError(func(err error) { received = append(received, err) })
+
+	boom := errors.New("boom")
+	fires := 0
+	agent.AddRecurringTimerSeconds(int64(0), func(a *Anagent) error {
+		fires++
+		if fires == 3 {
+			a.Stop()
+		}
+		return boom
+	})
+	agent.Start()
+	if len(received) != 3 || received[0] != boom {
+		t.Errorf("Expected the timer errors to be received, got %v", received)
+	}
+
+	agent.Fatal = true
+	received = received[:0]
+	fires = 0
+	agent.Start()
+	if len(received) != 1 || fires != 1 {
+		t.Errorf("Expected Fatal to stop the loop on the first error, got %d errors and %d fires", len(received), fires)
+	}
+}
+
+func TestRecoverPanics(t *testing.T) {
+	_, _, agent := manualAgent()
+	agent.RecoverPanics = true
+	agent.BusyLoop = true
+	received := []error{}
+	agent.OnError(func(err error) { received = append(received, err) })
+
+	panics, fires := 0, 0
+	agent.TimerSeconds(int64(1), true, func() {
+		panics++
+		panic("boom")
+	})
+	agent.TimerSeconds(int64(2), true, func() { fires++ })
+	agent.Use(func() { panic("middleware") })
+
+	agent.Advance(4 * time.Second)
+	if panics != 4 || fires != 2 {
+		t.Errorf("Expected the timers to keep firing, got %d panics and %d fires", panics, fires)
+	}
+	agent.Step()
+	if len(received) != 5 || received[0].Error() != "recovered handler panic: boom" {
+		t.Errorf("Expected the panics to be received as errors, got %v", received)
+	}
+	if received[4].Error() != "recovered handler panic: middleware" {
+		t.Errorf("Expected the middleware panic to be received, got %v", received[4])
+	}
+}
+
+func TestRecoverPanicsTasks(t *testing.T) {
+	agent := New()
+	agent.RecoverPanics = true
+	agent.BusyLoop = true
+	received := []string{}
+	agent.OnError(func(err error) { received = append(received, err.Error()) })
+
+	agent.AfterTicks(1, func() { panic("tick") })
+	agent.AfterTicks(1, func() error { return errors.New("failed tick") })
+	agent.Step()
+	agent.Next(func() { panic("next") })
+	agent.flushNext()
+
+	expected := []string{"recovered handler panic: tick", "failed tick", "recovered handler panic: next"}
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("Expected the task panics and errors to be received, got %v", received)
+	}
+}
+
+func TestOnErrorRemovedTimer(t *testing.T) {
+	agent := New()
+	agent.BusyLoop = true
+	received := make(chan error, 2)
+	agent.OnError(func(err error) { received <- err })
+
+	var self TimerID
+	self = agent.TimerSeconds(int64(0), true, func(a *Anagent) error {
+		a.RemoveTimer(self)
+		return errors.New("self")
+	})
+	agent.Step()
+
+	id := agent.TimerSeconds(int64(0), false, func() error {
+		time.Sleep(10 * time.Millisecond)
+		return errors.New("concurrent")
+	})
+	agent.SetConcurrent(id, true)
+	agent.Step()
+	if err := agent.AssertNoLeaks(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	close(received)
+	errs := []string{}
+	for err := range received {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) != 2 || errs[0] != "self" || errs[1] != "concurrent" {
+		t.Errorf("Expected the errors of removed timers to be received, got %v", errs)
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2017-2018 Ettore Di Giacinto
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+// OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+// DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package anagent
+
+import "fmt"
+
+// EventStat holds the counters of an event:
+// Emitted is the number of emissions made with Emit or EmitSync,
+// Invocations the number of invocations of the listeners bound
+// with On, Once or OnRetry.
+type EventStat struct {
+	Emitted     uint64
+	Invocations uint64
+}
+
+// SetEventStats enables or disables the event counters exposed by EventStats.
+func (a *Anagent) SetEventStats(enabled bool) {
+	a.statsAccess.Lock()
+	defer a.statsAccess.Unlock()
+	a.eventStatsEnabled = enabled
+	if enabled && a.eventStats == nil {
+		a.eventStats = make(map[string]*EventStat)
+	}
+}
+
+// EventStats returns the counters of the events, keyed by the event
+// formatted as string, since the event stats were enabled.
+func (a *Anagent) EventStats() map[string]EventStat {
+	a.statsAccess.Lock()
+	defer a.statsAccess.Unlock()
+
+	stats := make(map[string]EventStat, len(a.eventStats))
+	for k, v := range a.eventStats {
+		stats[k] = *v
+	}
+	return stats
+}
+
+// countEvent increments the counters of the event, if the stats are enabled.
+func (a *Anagent) countEvent(event interface{}, emitted, invocations uint64) {
+	a.statsAccess.Lock()
+	defer a.statsAccess.Unlock()
+
+	if !a.eventStatsEnabled {
+		return
+	}
+
+	key := fmt.Sprint(event)
+	stat, ok := a.eventStats[key]
+	if !ok {
+		stat = &EventStat{}
+		a.eventStats[key] = stat
+	}
+	stat.Emitted += emitted
+	stat.Invocations += invocations
+}
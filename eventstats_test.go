@@ -0,0 +1,34 @@
+package anagent
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEventStats(t *testing.T) {
+	agent := New()
+	agent.On("ping", func() {})
+	agent.On("ping", func() {})
+	agent.Once("pong", func() {})
+
+	agent.Emit("ping")
+	if len(agent.EventStats()) != 0 {
+		t.Errorf("Events were counted while stats were disabled")
+	}
+
+	agent.SetEventStats(true)
+	agent.Emit("ping")
+	agent.EmitSync("ping")
+	agent.Emit("pong")
+	agent.Emit("pong")
+	agent.Emit("nobody")
+
+	expected := map[string]EventStat{
+		"ping":   {Emitted: 2, Invocations: 4},
+		"pong":   {Emitted: 2, Invocations: 1},
+		"nobody": {Emitted: 1, Invocations: 0},
+	}
+	if stats := agent.EventStats(); !reflect.DeepEqual(stats, expected) {
+		t.Errorf("Unexpected event stats: %v", stats)
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2017-2018 Ettore Di Giacinto
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+// OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+// DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package anagent
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Group manages the lifecycle of several agents together.
+type Group struct {
+	agents []*Anagent
+	wg     sync.WaitGroup
+
+	cancelAccess sync.Mutex
+	ctx          context.Context
+	cancel       context.CancelFunc
+
+	errAccess sync.Mutex
+	err       error
+}
+
+// NewGroup returns a Group of the given agents.
+func NewGroup(agents ...*Anagent) *Group {
+	return &Group{agents: agents}
+}
+
+// Agents returns the agents of the Group.
+func (g *Group) Agents() []*Anagent {
+	return append([]*Anagent{}, g.agents...)
+}
+
+// StartAll starts each agent of the Group in its own goroutine.
+// If an agent is stopped by a fatal error, returned by a startup task or,
+// with Fatal, by a handler, the rest of the Group is stopped and the error
+// is returned by Wait.
+func (g *Group) StartAll() {
+	g.cancelAccess.Lock()
+	if g.ctx == nil || g.ctx.Err() != nil {
+		g.ctx, g.cancel = context.WithCancel(context.Background())
+	}
+	ctx := g.ctx
+	g.cancelAccess.Unlock()
+
+	for _, a := range g.agents {
+		g.wg.Add(1)
+		go func(a *Anagent) {
+			defer g.wg.Done()
+			a.StartContext(ctx)
+			if err := a.runError(); err != nil {
+				g.errAccess.Lock()
+				if g.err == nil {
+					g.err = err
+				}
+				g.errAccess.Unlock()
+				g.StopAll()
+			}
+		}(a)
+	}
+}
+
+// StopAll stops every agent of the Group, including the agents
+// started with StartAll that didn't start their loop yet.
+func (g *Group) StopAll() {
+	g.cancelAccess.Lock()
+	if g.cancel != nil {
+		g.cancel()
+	}
+	g.cancelAccess.Unlock()
+	for _, a := range g.agents {
+		a.Stop()
+	}
+}
+
+// Wait blocks until all the agents started with StartAll returned,
+// and returns the first fatal error, if any.
+func (g *Group) Wait() error {
+	g.wg.Wait()
+	g.errAccess.Lock()
+	defer g.errAccess.Unlock()
+	return g.err
+}
+
+// DriveChild drives the child agent from a recurring timer of the agent,
+// which Steps the child every interval, so the child doesn't need its own
+// goroutine. The child is started as with Start, running its startup tasks
+// and OnStart hooks, and set as BusyLoop so its Steps don't wait for its
+// timers. When the child is stopped, its OnStop hooks are run, the timer
+// is removed and its BusyLoop setting is restored. It returns the TimerID of the driving timer, or an empty one
+// if the child couldn't be started, e.g. because it is already started.
+func (a *Anagent) DriveChild(child *Anagent, every time.Duration) TimerID {
+	done, ok := child.begin(context.Background())
+	if !ok {
+		return ""
+	}
+	busy := child.BusyLoop
+	child.BusyLoop = true
+	if !child.startup() {
+		child.BusyLoop = busy
+		close(done)
+		return ""
+	}
+
+	var stopped sync.Once
+	stop := func() {
+		stopped.Do(func() {
+			child.shutdown()
+			child.BusyLoop = busy
+			close(done)
+		})
+	}
+	timer := &Timer{time: a.now().Add(every), after: every, recurring: true}
+	timer.handler = validateAndWrapHandler(func() {
+		if child.IsStarted() {
+			child.Step()
+		}
+		if child.IsStarted() {
+			return
+		}
+		// stop rescheduling the timer, so it is removed after this fire
+		a.Lock()
+		timer.maxRuns = timer.runs
+		a.Unlock()
+		stop()
+	})
+	id, err := a.addTimer(TimerID(""), timer)
+	if err != nil {
+		child.Stop()
+		stop()
+		return ""
+	}
+	return id
+}
@@ -0,0 +1,150 @@
+package anagent
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func waitStarted(t *testing.T, agents ...*Anagent) {
+	for _, a := range agents {
+		for i := 0; !a.IsStarted(); i++ {
+			if i > 1000 {
+				t.Fatal("Agent never started")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestGroup(t *testing.T) {
+	agents := []*Anagent{New(), New(), New()}
+	for _, a := range agents {
+		a.TimerSeconds(int64(1), true, func() {})
+	}
+	g := NewGroup(agents...)
+	g.StartAll()
+	waitStarted(t, agents...)
+
+	agents[1].Stop()
+	g.StopAll()
+
+	done := make(chan error)
+	go func() { done <- g.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Unexpected error from Wait: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Wait didn't return after StopAll")
+	}
+	for _, a := range agents {
+		if a.IsStarted() {
+			t.Error("Agent still started after StopAll")
+		}
+	}
+}
+
+func TestGroupFatal(t *testing.T) {
+	healthy := []*Anagent{New(), New()}
+	failing := New()
+	failing.Fatal = true
+	failing.StartupTask(0, func() error {
+		waitStarted(t, healthy...)
+		return errors.New("boom")
+	})
+
+	g := NewGroup(append(healthy, failing)...)
+	g.StartAll()
+
+	done := make(chan error)
+	go func() { done <- g.Wait() }()
+	select {
+	case err := <-done:
+		if err == nil || err.Error() != "boom" {
+			t.Errorf("Expected the fatal error to be propagated, got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Fatal error didn't stop the Group")
+	}
+}
+
+func TestGroupStopBeforeStart(t *testing.T) {
+	agents := []*Anagent{New(), New(), New()}
+	for _, a := range agents {
+		a.TimerSeconds(int64(1), true, func() {})
+	}
+	g := NewGroup(agents...)
+	g.StartAll()
+	g.StopAll()
+
+	done := make(chan error)
+	go func() { done <- g.Wait() }()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Wait didn't return after a StopAll racing with StartAll")
+	}
+}
+
+func TestGroupFatalHandler(t *testing.T) {
+	healthy := New()
+	healthy.TimerSeconds(int64(1), true, func() {})
+	failing := New()
+	failing.Fatal = true
+	failing.TimerSeconds(int64(0), false, func() error { return errors.New("handler") })
+
+	g := NewGroup(healthy, failing)
+	g.StartAll()
+
+	done := make(chan error)
+	go func() { done <- g.Wait() }()
+	select {
+	case err := <-done:
+		if err == nil || err.Error() != "handler" {
+			t.Errorf("Expected the handler error to be propagated, got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Fatal handler error didn't stop the Group")
+	}
+}
+
+func TestDriveChild(t *testing.T) {
+	parent, child := New(), New()
+	fires := 0
+	child.TimerSeconds(int64(0), true, func() {
+		fires++
+		if fires == 3 {
+			child.Stop()
+		}
+	})
+
+	hooks := []string{}
+	child.OnStart(func() { hooks = append(hooks, "start") })
+	child.OnStop(func() { hooks = append(hooks, "stop") })
+
+	id := parent.DriveChild(child, 10*time.Millisecond)
+	if !reflect.DeepEqual(hooks, []string{"start"}) {
+		t.Errorf("Expected the child OnStart hooks to run, got %v", hooks)
+	}
+	if parent.DriveChild(child, 10*time.Millisecond) != "" {
+		t.Error("Started child driven twice")
+	}
+	parent.SetRunDeadline(time.Now().Add(200 * time.Millisecond))
+	parent.Start()
+
+	if fires != 3 {
+		t.Errorf("Expected the child to be driven until stopped, fired %d", fires)
+	}
+	if parent.GetTimer(id) != nil {
+		t.Error("Driving timer not removed after the child stopped")
+	}
+	if !reflect.DeepEqual(hooks, []string{"start", "stop"}) {
+		t.Errorf("Expected the child OnStop hooks to run, got %v", hooks)
+	}
+	if child.BusyLoop {
+		t.Error("Child left in BusyLoop after it stopped")
+	}
+}
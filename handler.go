@@ -0,0 +1,194 @@
+// Copyright 2017-2018 Ettore Di Giacinto
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+// OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+// DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package anagent
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// funcName returns the name of the function f.
+func funcName(f interface{}) string {
+	return runtime.FuncForPC(reflect.ValueOf(f).Pointer()).Name()
+}
+
+// onStack returns true if the function with the given name
+// is in the stack of the calling goroutine.
+func onStack(name string) bool {
+	pcs := make([]uintptr, 64)
+	for skip := 2; ; skip += len(pcs) {
+		n := runtime.Callers(skip, pcs)
+		frames := runtime.CallersFrames(pcs[:n])
+		for {
+			f, more := frames.Next()
+			if f.Function == name {
+				return true
+			}
+			if !more {
+				break
+			}
+		}
+		if n < len(pcs) {
+			return false
+		}
+	}
+}
+
+// goroutineID returns the ID of the calling goroutine,
+// as reported in its stack trace.
+func goroutineID() uint64 {
+	var buf [64]byte
+	b := buf[:runtime.Stack(buf[:], false)]
+	b = bytes.TrimPrefix(b, []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i >= 0 {
+		b = b[:i]
+	}
+	id, _ := strconv.ParseUint(string(b), 10, 64)
+	return id
+}
+
+// goroutineSet holds the goroutines running a given kind of work
+// for an agent, e.g. its handlers, counting how many times each
+// goroutine entered it.
+type goroutineSet struct {
+	size   int32
+	access sync.Mutex
+	ids    map[uint64]int
+}
+
+// run runs f on the calling goroutine, which is in the set meanwhile.
+func (s *goroutineSet) run(f func()) {
+	id := goroutineID()
+	s.access.Lock()
+	if s.ids == nil {
+		s.ids = make(map[uint64]int)
+	}
+	s.ids[id]++
+	s.access.Unlock()
+	atomic.AddInt32(&s.size, 1)
+	defer func() {
+		atomic.AddInt32(&s.size, -1)
+		s.access.Lock()
+		if s.ids[id]--; s.ids[id] == 0 {
+			delete(s.ids, id)
+		}
+		s.access.Unlock()
+	}()
+	f()
+}
+
+// contains returns true if the calling goroutine is in the set.
+// The goroutine is looked up only if the set is not empty.
+func (s *goroutineSet) contains() bool {
+	if atomic.LoadInt32(&s.size) == 0 {
+		return false
+	}
+	id := goroutineID()
+	s.access.Lock()
+	defer s.access.Unlock()
+	return s.ids[id] > 0
+}
+
+// InHandler returns true if it is called from a middleware or a timer
+// handler run by the agent, on the goroutine running the handler.
+func (a *Anagent) InHandler() bool {
+	return a.handling.contains()
+}
+
+// runHandler runs f, which invokes a handler, with the calling
+// goroutine among the ones running handlers of the agent.
+func (a *Anagent) runHandler(f func()) {
+	a.handling.run(f)
+}
+
+// spawn runs f in a goroutine tracked by the agent.
+func (a *Anagent) spawn(f func()) {
+	a.goroutineStarted()
+	go func() {
+		defer a.goroutineDone()
+		f()
+	}()
+}
+
+// track runs f counting it among the goroutines run by the agent,
+// for the code run on goroutines that the agent doesn't spawn itself.
+// While the running Step emits events, they are the listeners it waits
+// for, so the goroutine is marked as part of the Step.
+func (a *Anagent) track(f func()) {
+	a.goroutineStarted()
+	defer a.goroutineDone()
+	if atomic.LoadInt32(&a.stepEmits) > 0 {
+		a.stepping.run(f)
+		return
+	}
+	f()
+}
+
+// goroutineStarted counts a goroutine run by the agent.
+func (a *Anagent) goroutineStarted() {
+	a.goroutinesAccess.Lock()
+	defer a.goroutinesAccess.Unlock()
+	a.goroutines++
+}
+
+// goroutineDone discounts a goroutine run by the agent,
+// waking up AssertNoLeaks once they are all done.
+func (a *Anagent) goroutineDone() {
+	a.goroutinesAccess.Lock()
+	defer a.goroutinesAccess.Unlock()
+	if a.goroutines--; a.goroutines == 0 {
+		a.goroutinesDone.Broadcast()
+	}
+}
+
+// AssertNoLeaks waits up to timeout for the goroutines run by the agent,
+// i.e. the concurrent timer handlers, the event listeners, the listeners
+// detached by SetListenerTimeout, the workers of the pool set with
+// SetWorkerPool and the signal handler set with HandleSignals, to exit.
+// It returns an error if some are still running.
+// It is meant to verify in tests that a shutdown was graceful,
+// so it has to be called once the agent is stopped.
+func (a *Anagent) AssertNoLeaks(timeout time.Duration) error {
+	expired := false
+	t := time.AfterFunc(timeout, func() {
+		a.goroutinesAccess.Lock()
+		defer a.goroutinesAccess.Unlock()
+		expired = true
+		a.goroutinesDone.Broadcast()
+	})
+	defer t.Stop()
+
+	a.goroutinesAccess.Lock()
+	defer a.goroutinesAccess.Unlock()
+	for a.goroutines > 0 && !expired {
+		a.goroutinesDone.Wait()
+	}
+	if a.goroutines > 0 {
+		return fmt.Errorf("%d agent goroutines still running after %v", a.goroutines, timeout)
+	}
+	return nil
+}
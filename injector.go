@@ -0,0 +1,105 @@
+// Copyright 2017-2018 Ettore Di Giacinto
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+// OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+// DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package anagent
+
+import (
+	"fmt"
+	"reflect"
+	"sync/atomic"
+
+	"github.com/codegangsta/inject"
+)
+
+// SetSafeInjector enables or disables the serialization of the injector access.
+// While enabled, the services needed by handlers are resolved under a
+// dedicated injector mutex, and Map, MapTo and Set can be used to map
+// services while handlers are running concurrently.
+// The mutex is not held while the handlers run, so they can safely call Map.
+func (a *Anagent) SetSafeInjector(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&a.safeInjector, v)
+}
+
+// Map maps the value in the agent injector, serializing the access
+// to the injector with the handlers resolving their arguments
+// under the safe injector, so it can be called while they run.
+func (a *Anagent) Map(val interface{}) inject.TypeMapper {
+	a.injectorAccess.Lock()
+	defer a.injectorAccess.Unlock()
+	return a.Injector.Map(val)
+}
+
+// MapTo maps the value in the agent injector as the given interface,
+// serializing the access to the injector like Map.
+func (a *Anagent) MapTo(val interface{}, ifacePtr interface{}) inject.TypeMapper {
+	a.injectorAccess.Lock()
+	defer a.injectorAccess.Unlock()
+	return a.Injector.MapTo(val, ifacePtr)
+}
+
+// Set maps the value in the agent injector as the given type,
+// serializing the access to the injector like Map.
+func (a *Anagent) Set(typ reflect.Type, val reflect.Value) inject.TypeMapper {
+	a.injectorAccess.Lock()
+	defer a.injectorAccess.Unlock()
+	return a.Injector.Set(typ, val)
+}
+
+// SafeMap maps the value in the agent injector. It is the same as Map,
+// which serializes the access to the injector with the running handlers.
+func (a *Anagent) SafeMap(val interface{}) inject.TypeMapper {
+	return a.Map(val)
+}
+
+// SafeMapTo maps the value in the agent injector as the given interface.
+// It is the same as MapTo, which serializes the access to the injector
+// with the running handlers.
+func (a *Anagent) SafeMapTo(val interface{}, ifacePtr interface{}) inject.TypeMapper {
+	return a.MapTo(val, ifacePtr)
+}
+
+// call invokes the handler with the given injector. When the safe injector
+// is enabled, or the agent is Concurrent, the arguments are resolved under
+// the injector mutex, which is released before calling the handler.
+func (a *Anagent) call(inj inject.Injector, handler Handler) ([]reflect.Value, error) {
+	if atomic.LoadInt32(&a.safeInjector) == 0 && !a.Concurrent {
+		return inj.Invoke(handler)
+	}
+
+	t := reflect.TypeOf(handler)
+	in := make([]reflect.Value, t.NumIn())
+
+	a.injectorAccess.RLock()
+	for i := range in {
+		val := inj.Get(t.In(i))
+		if !val.IsValid() {
+			a.injectorAccess.RUnlock()
+			return nil, fmt.Errorf("Value not found for type %v", t.In(i))
+		}
+		in[i] = val
+	}
+	a.injectorAccess.RUnlock()
+
+	return reflect.ValueOf(handler).Call(in), nil
+}
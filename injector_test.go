@@ -0,0 +1,46 @@
+package anagent
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSafeInjector(t *testing.T) {
+	agent := New()
+	agent.SetSafeInjector(true)
+	agent.Map(&TestTest{Test: "shared"})
+	var invoked, mapped int32
+
+	for i := 0; i < 4; i++ {
+		id := agent.Timer(TimerID(""), time.Now(), time.Millisecond, true, func(te *TestTest) {
+			if te.Test != "shared" {
+				t.Errorf("Unexpected injected value: %v", te)
+			}
+			atomic.AddInt32(&invoked, 1)
+		})
+		agent.SetConcurrent(id, true)
+	}
+	id := agent.Timer(TimerID("mapper"), time.Now(), time.Millisecond, true, func(a *Anagent) {
+		for i := 0; i < 10; i++ {
+			a.SafeMap(i)
+			a.SafeMapTo(a, (*interface{})(nil))
+			a.Map(i)
+			a.MapTo(a, (*interface{})(nil))
+		}
+		atomic.AddInt32(&mapped, 1)
+	})
+	agent.SetConcurrent(id, true)
+
+	agent.SetRunDeadline(time.Now().Add(100 * time.Millisecond))
+	agent.Start()
+	time.Sleep(10 * time.Millisecond)
+
+	if atomic.LoadInt32(&invoked) == 0 || atomic.LoadInt32(&mapped) == 0 {
+		t.Errorf("Handlers weren't invoked: %d invoked, %d mapped", invoked, mapped)
+	}
+
+	if _, err := agent.call(agent.Injector, func(s string) {}); err == nil {
+		t.Errorf("Missing services should return an error")
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2017-2018 Ettore Di Giacinto
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+// OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+// DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package anagent
+
+import (
+	"sort"
+	"time"
+)
+
+// startupTask is a Handler run once when the loop is started,
+// order defines its position among the other tasks.
+type startupTask struct {
+	order   int
+	handler Handler
+}
+
+// StartupTask registers a Handler that is run exactly once when the loop
+// is started with Start(), before the OnStart hooks and the first Step.
+// Tasks are run in ascending order, tasks sharing the same order
+// are run in the order they are registered.
+// If a task returns an error and Fatal is set, the startup is aborted
+// and Start() returns without running the loop.
+// It panics if the handler is not a callable func.
+func (a *Anagent) StartupTask(order int, handler Handler) {
+	a.Lock()
+	defer a.Unlock()
+
+	i := sort.Search(len(a.startupTasks), func(i int) bool {
+		return a.startupTasks[i].order > order
+	})
+	a.startupTasks = append(a.startupTasks, startupTask{})
+	copy(a.startupTasks[i+1:], a.startupTasks[i:])
+	a.startupTasks[i] = startupTask{order: order, handler: validateAndWrapHandler(handler)}
+}
+
+// runStartupTasks runs and clears the registered startup tasks.
+// It returns false if the startup has to be aborted.
+func (a *Anagent) runStartupTasks() bool {
+	a.Lock()
+	tasks := a.startupTasks
+	a.startupTasks = nil
+	a.startupErr = nil
+	a.fatalErr = nil
+	a.Unlock()
+
+	for _, task := range tasks {
+		if err := a.invoke(task.handler); err != nil && a.Fatal {
+			a.Lock()
+			a.startupErr = err
+			a.Unlock()
+			return false
+		}
+	}
+	return true
+}
+
+// runError returns the error that aborted the last run, if any: either
+// the error of a startup task, or with Fatal the error of a handler.
+func (a *Anagent) runError() error {
+	a.Lock()
+	defer a.Unlock()
+	if a.startupErr != nil {
+		return a.startupErr
+	}
+	return a.fatalErr
+}
+
+// OnStart adds a Handler that is invoked when the loop is started
+// with Start(), before the first Step.
+// It panics if the handler is not a callable func.
+func (a *Anagent) OnStart(handler Handler) {
+	a.Lock()
+	defer a.Unlock()
+	a.onStart = append(a.onStart, validateAndWrapHandler(handler))
+}
+
+// OnStop adds a Handler that is invoked when the loop
+// started with Start() is stopped, before Start() returns.
+// It panics if the handler is not a callable func.
+func (a *Anagent) OnStop(handler Handler) {
+	a.Lock()
+	defer a.Unlock()
+	a.onStop = append(a.onStop, validateAndWrapHandler(handler))
+}
+
+// HookPanicPolicy defines what happens when an OnStart or OnStop hook panics.
+type HookPanicPolicy int
+
+const (
+	// HookPanicPropagate lets the panic propagate out of Start
+	HookPanicPropagate HookPanicPolicy = iota
+	// HookPanicContinue recovers and logs the panic, and runs the remaining hooks
+	HookPanicContinue
+	// HookPanicAbort recovers and logs the panic, and skips the remaining hooks.
+	// A panicking OnStart hook also aborts the run: the loop is not started,
+	// while the OnStop hooks are run anyway
+	HookPanicAbort
+)
+
+// SetHookPanicPolicy sets the policies applied when the OnStart and
+// the OnStop hooks panic, by default panics are propagated.
+func (a *Anagent) SetHookPanicPolicy(onStart, onStop HookPanicPolicy) {
+	a.Lock()
+	defer a.Unlock()
+	a.startPanicPolicy = onStart
+	a.stopPanicPolicy = onStop
+}
+
+// runHooks invokes the given lifecycle hooks in order, applying the policy
+// to their panics. It returns false if a hook panicked with HookPanicAbort.
+func (a *Anagent) runHooks(hooks *[]Handler, policy *HookPanicPolicy) bool {
+	a.Lock()
+	handlers := append([]Handler{}, *hooks...)
+	p := *policy
+	a.Unlock()
+
+	for _, h := range handlers {
+		if !a.runHook(h, p) {
+			return false
+		}
+	}
+	return true
+}
+
+// runHook invokes a lifecycle hook, and returns false if it panicked
+// and the remaining hooks have to be skipped.
+func (a *Anagent) runHook(h Handler, policy HookPanicPolicy) (ok bool) {
+	if policy != HookPanicPropagate {
+		defer func() {
+			if r := recover(); r != nil {
+				a.Log().Printf("recovered hook panic: %v", r)
+				ok = policy == HookPanicContinue
+			}
+		}()
+	}
+	a.invoke(h)
+	return true
+}
+
+// SetRunDeadline sets an absolute time at which the loop stops,
+// regardless of the timers that are still pending.
+// It can be changed while the loop is running, and a zero time.Time
+// removes the deadline.
+func (a *Anagent) SetRunDeadline(t time.Time) {
+	a.StartedAccess.Lock()
+	defer a.StartedAccess.Unlock()
+
+	a.deadline = t
+	if a.deadlineTimer != nil {
+		a.deadlineTimer.Stop()
+		a.deadlineTimer = nil
+	}
+	if !t.IsZero() {
+		a.deadlineTimer = time.AfterFunc(time.Until(t), a.interrupt)
+	}
+	a.interrupt()
+}
+
+// RunDeadline returns the deadline set with SetRunDeadline,
+// or a zero time.Time if there is none.
+func (a *Anagent) RunDeadline() time.Time {
+	a.StartedAccess.Lock()
+	defer a.StartedAccess.Unlock()
+	return a.deadline
+}
+
+// checkDeadline stops the agent if the run deadline was reached,
+// and returns true in such case.
+func (a *Anagent) checkDeadline() bool {
+	a.StartedAccess.Lock()
+	reached := !a.deadline.IsZero() && !a.now().Before(a.deadline)
+	if reached {
+		a.deadline = time.Time{}
+	}
+	a.StartedAccess.Unlock()
+
+	if reached {
+		a.Stop()
+	}
+	return reached
+}
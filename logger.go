@@ -0,0 +1,43 @@
+// Copyright 2017-2018 Ettore Di Giacinto
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+// OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+// DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package anagent
+
+// Logger is the interface of the agent logger, satisfied by *log.Logger.
+// The agent logger is mapped as Logger, so handlers can receive it by injection.
+type Logger interface {
+	Printf(format string, v ...interface{})
+	Println(v ...interface{})
+}
+
+// WithLogger replaces the agent logger, which by default is a *log.Logger
+// writing to stderr. The logger is mapped as Logger, and it is used as is:
+// the name set with WithName is shown only in the prefix of the default one.
+func WithLogger(l Logger) Option {
+	return func(a *Anagent) {
+		a.log = l
+		a.MapTo(l, (*Logger)(nil))
+	}
+}
+
+// Log returns the agent logger, for logging outside of the handlers.
+func (a *Anagent) Log() Logger {
+	return a.log
+}
@@ -0,0 +1,56 @@
+package anagent
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeLogger records the logged lines.
+type fakeLogger struct {
+	lines []string
+}
+
+func (l *fakeLogger) Printf(format string, v ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func (l *fakeLogger) Println(v ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprint(v...))
+}
+
+func TestLoggerInjection(t *testing.T) {
+	logger := &fakeLogger{}
+	agent := NewWithOptions(WithLogger(logger))
+
+	agent.Invoke(func(l Logger) { l.Printf("from %s", "handler") })
+	agent.Log().Println("imperative")
+	if !reflect.DeepEqual(logger.lines, []string{"from handler", "imperative"}) {
+		t.Errorf("Unexpected logged lines: %v", logger.lines)
+	}
+
+	agent = New()
+	if agent.Log() != Logger(agent.logger) {
+		t.Error("Expected the default logger to be the *log.Logger")
+	}
+}
+
+func TestWarnOnDuplicateHandler(t *testing.T) {
+	logger := &fakeLogger{}
+	agent := NewWithOptions(WithLogger(logger))
+	agent.WarnOnDuplicateHandler(true)
+
+	agent.Use(namedTestHandler)
+	agent.Use(func() {})
+	if len(logger.lines) != 0 {
+		t.Errorf("Unexpected warnings: %v", logger.lines)
+	}
+	agent.Use(namedTestHandler)
+	if len(logger.lines) != 1 || !strings.Contains(logger.lines[0], "namedTestHandler") {
+		t.Errorf("Expected a warning for the duplicate handler: %v", logger.lines)
+	}
+
+	agent.SetMaxHandlers(3)
+	assertPanic(t, func() { agent.Use(func() {}) })
+}
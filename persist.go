@@ -0,0 +1,115 @@
+// Copyright 2017-2018 Ettore Di Giacinto
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+// OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+// DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package anagent
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// MarshalText implements encoding.TextMarshaler
+func (id TimerID) MarshalText() ([]byte, error) {
+	return []byte(id), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler,
+// it returns an error if the supplied text is empty.
+func (id *TimerID) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		return errors.New("Anagent TimerID cannot be empty")
+	}
+	*id = TimerID(text)
+	return nil
+}
+
+// TimerSet is the set of the active timers,
+// it maps each TimerID to its label.
+type TimerSet map[TimerID]string
+
+// TimerSet returns a snapshot of the active timers along with their labels.
+func (a *Anagent) TimerSet() TimerSet {
+	a.Lock()
+	defer a.Unlock()
+
+	set := make(TimerSet, len(a.timers))
+	for id, t := range a.timers {
+		set[id] = t.label
+	}
+	return set
+}
+
+// MarshalTimerSet serializes the set of the active timers,
+// with their labels, to JSON.
+func (a *Anagent) MarshalTimerSet() ([]byte, error) {
+	return json.Marshal(a.TimerSet())
+}
+
+// UnmarshalTimerSet parses a JSON set of timers,
+// as serialized by MarshalTimerSet.
+func UnmarshalTimerSet(data []byte) (TimerSet, error) {
+	set := TimerSet{}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// PhaseOf returns the phase of a recurring timer, that is the time elapsed
+// in its current interval, so it can be checkpointed and restored with
+// RestorePhase. It returns zero if the timer does not exist or it isn't recurring.
+func (a *Anagent) PhaseOf(id TimerID) time.Duration {
+	now := a.now()
+	a.Lock()
+	defer a.Unlock()
+	t, ok := a.timers[id]
+	if !ok || !t.recurring || t.after <= 0 {
+		return 0
+	}
+
+	phase := t.after - t.time.Sub(now)
+	if phase < 0 {
+		return 0
+	}
+	if phase > t.after {
+		return t.after
+	}
+	return phase
+}
+
+// RestorePhase reschedules a recurring timer so its next fire is aligned
+// with the phase returned by PhaseOf, as if the timer had been running
+// continuously. It requires a TimerID, and returns false
+// if the timer does not exist or it isn't recurring.
+func (a *Anagent) RestorePhase(id TimerID, phase time.Duration) bool {
+	now := a.now()
+	a.Lock()
+	defer a.Unlock()
+	t, ok := a.timers[id]
+	if !ok || !t.recurring || t.after <= 0 {
+		return false
+	}
+
+	t.time = now.Add(t.after - phase%t.after)
+	a.rescheduleDependents(id, t)
+	a.interrupt()
+	return true
+}
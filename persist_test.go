@@ -0,0 +1,86 @@
+package anagent
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTimerIDText(t *testing.T) {
+	var id TimerID
+	if err := id.UnmarshalText([]byte("backup")); err != nil {
+		t.Fatal(err)
+	}
+	text, err := id.MarshalText()
+	if err != nil || string(text) != "backup" {
+		t.Errorf("TimerID didn't round trip: %s %v", text, err)
+	}
+
+	if err := id.UnmarshalText([]byte{}); err == nil {
+		t.Errorf("Empty TimerID should be refused")
+	}
+}
+
+func TestMarshalTimerSet(t *testing.T) {
+	agent := New()
+	backup := agent.AddRecurringTimerSeconds(int64(60), func() {})
+	agent.SetLabel(backup, "backup")
+	cleanup := agent.Timer(TimerID("cleanup"), agent.timers[backup].time, 0, false, func() {})
+	agent.SetLabel(cleanup, "cleanup-job")
+	unlabeled := agent.AddTimerSeconds(int64(60), func() {})
+
+	if agent.SetLabel(TimerID("missing"), "nope") {
+		t.Errorf("SetLabel should fail on missing timers")
+	}
+
+	data, err := agent.MarshalTimerSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set, err := UnmarshalTimerSet(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := TimerSet{backup: "backup", cleanup: "cleanup-job", unlabeled: ""}
+	if !reflect.DeepEqual(set, expected) {
+		t.Errorf("Timer set didn't round trip: %v", set)
+	}
+	if agent.Label(cleanup) != "cleanup-job" {
+		t.Errorf("Unexpected label: %s", agent.Label(cleanup))
+	}
+
+	if _, err := UnmarshalTimerSet([]byte(`{"": "empty"}`)); err == nil {
+		t.Errorf("Empty TimerIDs should be refused")
+	}
+}
+
+func TestRestorePhase(t *testing.T) {
+	_, clock, agent := manualAgent()
+	id := agent.TimerSeconds(int64(10), true, func() {})
+
+	agent.Advance(13 * time.Second)
+	phase := agent.PhaseOf(id)
+	if phase != 3*time.Second {
+		t.Fatalf("Expected a phase of 3s, got %v", phase)
+	}
+
+	// The agent restarts later, with the timer reset to now plus its interval
+	clock.Add(time.Minute)
+	restarted := NewWithOptions(WithClock(clock))
+	fires := []time.Time{}
+	restarted.Timer(id, clock.Now().Add(10*time.Second), 10*time.Second, true, func() { fires = append(fires, clock.Now()) })
+	if !restarted.RestorePhase(id, phase) {
+		t.Fatal("RestorePhase didn't find the timer")
+	}
+
+	restored := clock.Now()
+	restarted.Advance(20 * time.Second)
+	if len(fires) != 2 || fires[0] != restored.Add(7*time.Second) || fires[1] != restored.Add(17*time.Second) {
+		t.Errorf("Expected fires at the remaining phase offset, got %v", fires)
+	}
+	if restarted.PhaseOf(TimerID("missing")) != 0 || restarted.RestorePhase(TimerID("missing"), phase) {
+		t.Error("Phase reported for a missing timer")
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2017-2018 Ettore Di Giacinto
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+// OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+// DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package anagent
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// workerPool is a fixed set of goroutines running the jobs
+// sent to a buffered channel.
+type workerPool struct {
+	access         sync.RWMutex
+	jobs           chan func()
+	closed         bool
+	queued, active int64
+}
+
+// workerFrame is the name of the function run by the workers,
+// looked up in the stack of a goroutine to tell if it is a worker.
+var workerFrame = funcName((*workerPool).work)
+
+// newWorkerPool starts a pool of n workers with the spawn function.
+func newWorkerPool(n int, spawn func(func())) *workerPool {
+	p := &workerPool{jobs: make(chan func(), n)}
+	for i := 0; i < n; i++ {
+		spawn(p.work)
+	}
+	return p
+}
+
+// work runs the jobs of the pool until it is closed.
+//
+//go:noinline
+func (p *workerPool) work() {
+	for job := range p.jobs {
+		atomic.AddInt64(&p.queued, -1)
+		atomic.AddInt64(&p.active, 1)
+		job()
+		atomic.AddInt64(&p.active, -1)
+	}
+}
+
+// isWorker returns true if it is called by a worker of any pool.
+func isWorker() bool {
+	return onStack(workerFrame)
+}
+
+// submit queues the job, blocking while the pool is saturated.
+// It returns false if the pool was closed.
+func (p *workerPool) submit(job func()) bool {
+	p.access.RLock()
+	defer p.access.RUnlock()
+	if p.closed {
+		return false
+	}
+	atomic.AddInt64(&p.queued, 1)
+	p.jobs <- job
+	return true
+}
+
+// close stops the workers once the queued jobs are done.
+func (p *workerPool) close() {
+	p.access.Lock()
+	defer p.access.Unlock()
+	if !p.closed {
+		p.closed = true
+		close(p.jobs)
+	}
+}
+
+// SetWorkerPool runs the timer and middleware handlers on a fixed pool of n
+// workers, instead of the loop goroutine and of a goroutine for each
+// concurrent handler. When all the workers are busy and the queue of n jobs
+// is full, Step blocks until a worker frees up. The loop still waits for the
+// middleware and for the timer handlers that are not concurrent, which are
+// queued like the others: they wait behind the jobs already in the pool,
+// so slow concurrent handlers can delay them. Handlers run by a worker that
+// invoke other handlers, e.g. with StopAndDrain, run them outside the pool.
+// A value lower than 1 stops the workers, once their jobs are done.
+// The workers keep running until the pool is stopped.
+func (a *Anagent) SetWorkerPool(n int) {
+	var pool *workerPool
+	if n > 0 {
+		pool = newWorkerPool(n, a.spawn)
+	}
+
+	a.Lock()
+	old := a.pool
+	a.pool = pool
+	a.Unlock()
+	if old != nil {
+		old.close()
+	}
+}
+
+// WorkerStats returns the number of jobs waiting for a worker of the pool
+// set with SetWorkerPool, and the number of jobs running.
+// It returns zero counts if there is no pool.
+func (a *Anagent) WorkerStats() (queued, active int) {
+	a.Lock()
+	pool := a.pool
+	a.Unlock()
+	if pool == nil {
+		return 0, 0
+	}
+	return int(atomic.LoadInt64(&pool.queued)), int(atomic.LoadInt64(&pool.active))
+}
+
+// goPooled runs the job on the worker pool if there is one,
+// otherwise in a goroutine. Either way, the job is tracked by the agent.
+func (a *Anagent) goPooled(job func()) {
+	a.Lock()
+	pool := a.pool
+	a.Unlock()
+
+	if pool != nil && !isWorker() {
+		a.goroutineStarted()
+		if pool.submit(func() {
+			defer a.goroutineDone()
+			job()
+		}) {
+			return
+		}
+		a.goroutineDone()
+	}
+	a.spawn(job)
+}
+
+// runPooled runs the job on the worker pool if there is one,
+// waiting for it to complete, otherwise it runs it in place.
+// A panic of the job is propagated to the caller.
+func (a *Anagent) runPooled(job func()) {
+	a.Lock()
+	pool := a.pool
+	a.Unlock()
+
+	result := make(chan interface{}, 1)
+	if pool == nil || isWorker() || !pool.submit(func() {
+		defer func() { result <- recover() }()
+		job()
+	}) {
+		job()
+		return
+	}
+	if r := <-result; r != nil {
+		panic(r)
+	}
+}
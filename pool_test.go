@@ -0,0 +1,108 @@
+package anagent
+
+import (
+	"testing"
+	"time"
+)
+
+// waitWorkerStats waits until the worker pool reports the given counts.
+func waitWorkerStats(t *testing.T, a *Anagent, queued, active int) {
+	for i := 0; ; i++ {
+		q, r := a.WorkerStats()
+		if q == queued && r == active {
+			return
+		}
+		if i > 1000 {
+			t.Fatalf("Expected %d queued and %d active jobs, got %d and %d", queued, active, q, r)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSetWorkerPool(t *testing.T) {
+	agent := New()
+	agent.Concurrent = true
+	agent.BusyLoop = true
+	agent.SetWorkerPool(2)
+	defer agent.SetWorkerPool(0)
+
+	release := make(chan struct{})
+	done := make(chan struct{}, 6)
+	for i := 0; i < 6; i++ {
+		agent.AddTimerSeconds(int64(0), func() {
+			<-release
+			done <- struct{}{}
+		})
+	}
+
+	for i := 0; i < 4; i++ {
+		agent.Step()
+	}
+	waitWorkerStats(t, agent, 2, 2)
+
+	// the pool is saturated: the next Step blocks submitting its job
+	stepped := make(chan struct{})
+	go func() {
+		agent.Step()
+		close(stepped)
+	}()
+	waitWorkerStats(t, agent, 3, 2)
+	select {
+	case <-stepped:
+		t.Fatal("Step didn't block on the saturated pool")
+	default:
+	}
+
+	close(release)
+	<-stepped
+	agent.Step()
+	for i := 0; i < 6; i++ {
+		select {
+		case <-done:
+		case <-time.After(3 * time.Second):
+			t.Fatalf("Expected 6 handlers to run, got %d", i)
+		}
+	}
+	waitWorkerStats(t, agent, 0, 0)
+
+	caller := goroutineID()
+	var worker uint64
+	agent.Use(func() { worker = goroutineID() })
+	agent.Step()
+	if worker == 0 || worker == caller {
+		t.Error("Middleware not run by the pool")
+	}
+
+	if err := agent.AssertNoLeaks(5 * time.Millisecond); err == nil {
+		t.Error("Expected the workers to be reported while the pool runs")
+	}
+	agent.SetWorkerPool(0)
+	if err := agent.AssertNoLeaks(time.Second); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWorkerPoolNested(t *testing.T) {
+	agent := New()
+	agent.BusyLoop = true
+	agent.SetWorkerPool(1)
+	defer agent.SetWorkerPool(0)
+
+	drained := 0
+	agent.Timer(TimerID("b"), time.Now().Add(-time.Second), 0, false, func() { drained++ })
+	agent.Timer(TimerID("a"), time.Now().Add(-2*time.Second), 0, false, func(a *Anagent) { a.StopAndDrain() })
+
+	stepped := make(chan struct{})
+	go func() {
+		agent.Step()
+		close(stepped)
+	}()
+	select {
+	case <-stepped:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Handler invoking other handlers deadlocked the pool")
+	}
+	if drained != 1 {
+		t.Errorf("Expected the drained timer to fire once, fired %d", drained)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2017-2018 Ettore Di Giacinto
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+// OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+// DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package anagent
+
+import (
+	"time"
+
+	"github.com/codegangsta/inject"
+)
+
+// SetProfiling enables or disables the profiling of the handlers:
+// while enabled, the execution time of middleware and timer handlers
+// is accumulated and exposed by HandlerProfile.
+func (a *Anagent) SetProfiling(enabled bool) {
+	a.statsAccess.Lock()
+	defer a.statsAccess.Unlock()
+	a.profiling = enabled
+	if enabled && a.profile == nil {
+		a.profile = make(map[string]time.Duration)
+	}
+}
+
+// HandlerProfile returns the cumulative execution time of each handler
+// since profiling was enabled. Timers are keyed by their label if set,
+// other handlers by their function name.
+func (a *Anagent) HandlerProfile() map[string]time.Duration {
+	a.statsAccess.Lock()
+	defer a.statsAccess.Unlock()
+
+	profile := make(map[string]time.Duration, len(a.profile))
+	for k, v := range a.profile {
+		profile[k] = v
+	}
+	return profile
+}
+
+// invokeProfiled invokes the handler with the injector, and when profiling is enabled
+// accumulates its execution time under the label, or under the
+// handler function name if the label is empty.
+func (a *Anagent) invokeProfiled(inj inject.Injector, label string, handler Handler) error {
+	a.statsAccess.Lock()
+	profiling := a.profiling
+	a.statsAccess.Unlock()
+
+	if !profiling {
+		return a.invokeIn(inj, handler)
+	}
+
+	start := time.Now()
+	err := a.invokeIn(inj, handler)
+	elapsed := time.Since(start)
+
+	if label == "" {
+		label = handlerName(handler)
+	}
+	a.statsAccess.Lock()
+	a.profile[label] += elapsed
+	a.statsAccess.Unlock()
+
+	return err
+}
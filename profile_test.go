@@ -0,0 +1,35 @@
+package anagent
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHandlerProfile(t *testing.T) {
+	agent := New()
+	agent.BusyLoop = true
+	agent.SetProfiling(true)
+
+	middleware := func() { time.Sleep(20 * time.Millisecond) }
+	agent.Use(middleware)
+	fast := agent.Timer(TimerID("fast"), time.Now(), 0, true, func() { time.Sleep(5 * time.Millisecond) })
+	agent.SetLabel(fast, "fast")
+	slow := agent.Timer(TimerID("slow"), time.Now(), 0, true, func() { time.Sleep(60 * time.Millisecond) })
+	agent.SetLabel(slow, "slow")
+
+	for i := 0; i < 4; i++ {
+		agent.Step()
+	}
+
+	profile := agent.HandlerProfile()
+	mw := profile[handlerName(middleware)]
+	if !(profile["slow"] > mw && mw > profile["fast"] && profile["fast"] > 0) {
+		t.Errorf("Profile doesn't rank handlers correctly: %v", profile)
+	}
+
+	agent.SetProfiling(false)
+	agent.Step()
+	if agent.HandlerProfile()[handlerName(middleware)] != mw {
+		t.Errorf("Handlers were profiled while profiling was disabled")
+	}
+}
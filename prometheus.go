@@ -0,0 +1,89 @@
+// Copyright 2017-2018 Ettore Di Giacinto
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+// OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+// DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package anagent
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// promEscaper escapes the values of the Prometheus labels.
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// WritePrometheus writes the stats of the timers in the Prometheus text
+// exposition format: the number of active timers, and for each timer,
+// labeled by its ID and label, its fires, the drift of its last fire
+// from its schedule, and the duration of its handler executions.
+func (a *Anagent) WritePrometheus(w io.Writer) error {
+	type stat struct {
+		id, label string
+		fires     int
+		drift     float64
+		busy      float64
+		completed int
+	}
+
+	a.Lock()
+	active := 0
+	stats := make([]stat, 0, len(a.timers))
+	for id, t := range a.timers {
+		if !t.paused {
+			active++
+		}
+		stats = append(stats, stat{id: string(id), label: t.label, fires: t.runs,
+			drift: t.drift.Seconds(), busy: t.busy.Seconds(), completed: t.completed})
+	}
+	a.Unlock()
+	sort.Slice(stats, func(i, j int) bool { return stats[i].id < stats[j].id })
+
+	var buf bytes.Buffer
+	header := func(name, help, kind string) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	labels := func(s stat) string {
+		return fmt.Sprintf(`{timer="%s",label="%s"}`, promEscaper.Replace(s.id), promEscaper.Replace(s.label))
+	}
+
+	header("anagent_active_timers", "Number of active timers.", "gauge")
+	fmt.Fprintf(&buf, "anagent_active_timers %d\n", active)
+
+	header("anagent_timer_fires_total", "Number of fires of the timer.", "counter")
+	for _, s := range stats {
+		fmt.Fprintf(&buf, "anagent_timer_fires_total%s %d\n", labels(s), s.fires)
+	}
+
+	header("anagent_timer_last_drift_seconds", "Delay of the last fire of the timer from its schedule.", "gauge")
+	for _, s := range stats {
+		fmt.Fprintf(&buf, "anagent_timer_last_drift_seconds%s %g\n", labels(s), s.drift)
+	}
+
+	header("anagent_handler_duration_seconds", "Execution time of the timer handler.", "summary")
+	for _, s := range stats {
+		fmt.Fprintf(&buf, "anagent_handler_duration_seconds_sum%s %g\n", labels(s), s.busy)
+		fmt.Fprintf(&buf, "anagent_handler_duration_seconds_count%s %d\n", labels(s), s.completed)
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,53 @@
+package anagent
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	start, clock, agent := manualAgent()
+
+	poll := agent.Timer(TimerID("poll"), start.Add(time.Second), time.Second, true, func() {
+		time.Sleep(time.Millisecond)
+	})
+	agent.SetLabel(poll, `db "primary"`)
+	agent.Timer(TimerID("idle"), start.Add(time.Hour), time.Hour, false, func() {})
+	agent.Advance(3 * time.Second)
+
+	// the last fire of poll happens 500ms late
+	clock.Add(1500 * time.Millisecond)
+	agent.Step()
+
+	var buf bytes.Buffer
+	if err := agent.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+
+	for _, line := range []string{
+		"# TYPE anagent_active_timers gauge",
+		"anagent_active_timers 2",
+		"# TYPE anagent_timer_fires_total counter",
+		`anagent_timer_fires_total{timer="poll",label="db \"primary\""} 4`,
+		`anagent_timer_fires_total{timer="idle",label=""} 0`,
+		`anagent_timer_last_drift_seconds{timer="poll",label="db \"primary\""} 0.5`,
+		`anagent_handler_duration_seconds_count{timer="poll",label="db \"primary\""} 4`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("Missing line %q in:\n%s", line, out)
+		}
+	}
+
+	prefix := `anagent_handler_duration_seconds_sum{timer="poll",label="db \"primary\""} `
+	i := strings.Index(out, prefix)
+	if i < 0 {
+		t.Fatalf("Missing handler duration in:\n%s", out)
+	}
+	sum, err := time.ParseDuration(strings.SplitN(out[i+len(prefix):], "\n", 2)[0] + "s")
+	if err != nil || sum < 4*time.Millisecond || sum > time.Second {
+		t.Errorf("Implausible handler duration: %v %v", sum, err)
+	}
+}
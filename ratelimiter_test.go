@@ -0,0 +1,32 @@
+package anagent
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	agent := NewWithOptions(WithRateLimiter(10, 2))
+	allowed := []bool{}
+
+	agent.Use(func(rl *RateLimiter) {
+		allowed = append(allowed, rl.Allow())
+	})
+
+	agent.Step()
+	agent.Step()
+	agent.Step()
+
+	if !reflect.DeepEqual(allowed, []bool{true, true, false}) {
+		t.Errorf("Rate limiter didn't respect the burst: %v", allowed)
+	}
+
+	time.Sleep(110 * time.Millisecond)
+	agent.Step()
+	agent.Step()
+
+	if !reflect.DeepEqual(allowed, []bool{true, true, false, true, false}) {
+		t.Errorf("Rate limiter didn't refill at the configured rate: %v", allowed)
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2017-2018 Ettore Di Giacinto
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+// OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+// DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package anagent
+
+import "time"
+
+// readinessPoll is how often a held timer checks again the readiness gate.
+const readinessPoll = 10 * time.Millisecond
+
+// ReadinessPolicy defines what happens to the due timers
+// while the readiness gate is closed.
+type ReadinessPolicy int
+
+const (
+	// ReadinessSkip skips the fires of the recurring timers, which are
+	// rescheduled as usual, while one-shot timers are held
+	ReadinessSkip ReadinessPolicy = iota
+	// ReadinessHold holds all the due timers, which fire as soon as the gate opens
+	ReadinessHold
+)
+
+// SetReadinessGate sets a gate checked before any timer fires: while it
+// returns false no handler is run, and the due timers are deferred
+// according to the policy. Once it returns true, the timers fire as usual.
+// It is useful to hold periodic work until a dependency is available.
+// A nil gate removes it.
+func (a *Anagent) SetReadinessGate(gate func() bool, policy ReadinessPolicy) {
+	a.Lock()
+	defer a.Unlock()
+	a.readiness = gate
+	a.readinessPolicy = policy
+	a.interrupt()
+}
+
+// ready checks the readiness gate, if there is one.
+func (a *Anagent) ready() bool {
+	a.Lock()
+	gate := a.readiness
+	a.Unlock()
+	return gate == nil || gate()
+}
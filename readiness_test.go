@@ -0,0 +1,45 @@
+package anagent
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSetReadinessGate(t *testing.T) {
+	agent := New()
+	opening := time.Now().Add(300 * time.Millisecond)
+	agent.SetReadinessGate(func() bool { return !time.Now().Before(opening) }, ReadinessSkip)
+
+	fires := []time.Time{}
+	agent.Timer(TimerID(""), time.Now(), 50*time.Millisecond, true, func() { fires = append(fires, time.Now()) })
+	agent.SetRunDeadline(time.Now().Add(500 * time.Millisecond))
+	agent.Start()
+
+	if len(fires) == 0 {
+		t.Fatal("Timer never fired once the gate opened")
+	}
+	for _, f := range fires {
+		if f.Before(opening) {
+			t.Errorf("Timer fired %v before the gate opened", opening.Sub(f))
+		}
+	}
+}
+
+func TestReadinessHold(t *testing.T) {
+	start, clock, agent := manualAgent()
+	agent.SetReadinessGate(func() bool { return clock.Now().Sub(start) >= 5*time.Second }, ReadinessHold)
+
+	fires := []time.Duration{}
+	agent.TimerSeconds(int64(2), true, func() { fires = append(fires, clock.Now().Sub(start)) })
+	oneShot := time.Duration(0)
+	agent.TimerSeconds(int64(1), false, func() { oneShot = clock.Now().Sub(start) })
+
+	agent.Advance(8 * time.Second)
+	if oneShot != 5*time.Second {
+		t.Errorf("Expected the one-shot timer to fire when the gate opened, fired at %v", oneShot)
+	}
+	if !reflect.DeepEqual(fires, []time.Duration{5 * time.Second, 7 * time.Second}) {
+		t.Errorf("Expected the held timer to fire once ready, got %v", fires)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2017-2018 Ettore Di Giacinto
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+// OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+// DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package anagent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Kinds of the operations recorded with Record
+const (
+	OpTimer  = "timer"
+	OpRemove = "remove"
+	OpEmit   = "emit"
+	OpFire   = "fire"
+)
+
+// Operation is a timer or event operation recorded with Record.
+// Handlers can't be recorded, thus only their name is kept,
+// and events are recorded in their string form.
+type Operation struct {
+	Op        string        `json:"op"`
+	Time      time.Time     `json:"time"`
+	TimerID   TimerID       `json:"timer,omitempty"`
+	At        time.Time     `json:"at,omitempty"`
+	After     time.Duration `json:"after,omitempty"`
+	Recurring bool          `json:"recurring,omitempty"`
+	Handler   string        `json:"handler,omitempty"`
+	Cron      string        `json:"cron,omitempty"`
+	Event     string        `json:"event,omitempty"`
+}
+
+// Record makes the agent write each timer and event operation to w,
+// as a JSON object per line, so it can be reproduced with Replay.
+// A nil writer stops the recording.
+func (a *Anagent) Record(w io.Writer) {
+	a.recordAccess.Lock()
+	defer a.recordAccess.Unlock()
+	if w == nil {
+		a.recorder = nil
+		return
+	}
+	a.recorder = json.NewEncoder(w)
+}
+
+// record writes the operation, if the recording is enabled.
+func (a *Anagent) record(op Operation) {
+	a.recordAccess.Lock()
+	defer a.recordAccess.Unlock()
+	if a.recorder == nil {
+		return
+	}
+	op.Time = a.now()
+	a.recorder.Encode(op)
+}
+
+// Replay reads the operations written by Record, and applies them to the agent:
+// timers are created again with their ID and schedule, resolving their handler
+// with the callback, cron timers are scheduled again from their expression,
+// removed timers are removed, and events are emitted with EmitSync.
+// Timers whose handler resolves to nil are skipped, while the
+// recorded fires are not applied, as they result from the schedule.
+func (a *Anagent) Replay(r io.Reader, resolve func(op Operation) Handler) error {
+	dec := json.NewDecoder(r)
+	for {
+		var op Operation
+		err := dec.Decode(&op)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch op.Op {
+		case OpTimer:
+			h := resolve(op)
+			switch {
+			case h == nil:
+			case op.Cron != "":
+				if _, err := a.CronTimer(op.TimerID, op.Cron, h); err != nil {
+					return err
+				}
+			default:
+				a.Timer(op.TimerID, op.At, op.After, op.Recurring, h)
+			}
+		case OpRemove:
+			a.RemoveTimer(op.TimerID)
+		case OpEmit:
+			a.EmitSync(op.Event)
+		case OpFire:
+		default:
+			return fmt.Errorf("unknown operation %q", op.Op)
+		}
+	}
+}
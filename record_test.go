@@ -0,0 +1,59 @@
+package anagent
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func fireOps(t *testing.T, data []byte) []Operation {
+	ops := []Operation{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for dec.More() {
+		var op Operation
+		if err := dec.Decode(&op); err != nil {
+			t.Fatal(err)
+		}
+		if op.Op == OpFire {
+			ops = append(ops, op)
+		}
+	}
+	return ops
+}
+
+func TestRecordReplay(t *testing.T) {
+	var session bytes.Buffer
+	_, _, recorded := manualAgent()
+	recorded.Record(&session)
+	recorded.TimerSeconds(int64(2), true, func() {})
+	recorded.TimerSeconds(int64(5), false, func() {})
+	removed := recorded.TimerSeconds(int64(1), true, func() {})
+	recorded.RemoveTimer(removed)
+	recorded.Emit("started")
+	recorded.Advance(10 * time.Second)
+
+	var replayed bytes.Buffer
+	_, _, agent := manualAgent()
+	emitted := 0
+	agent.On("started", func() { emitted++ })
+	resolved := []string{}
+	err := agent.Replay(bytes.NewReader(session.Bytes()), func(op Operation) Handler {
+		resolved = append(resolved, op.Handler)
+		return func() {}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent.Record(&replayed)
+	agent.Advance(10 * time.Second)
+
+	if len(resolved) != 3 || emitted != 1 {
+		t.Errorf("Expected 3 timers resolved and 1 event emitted, got %v and %d", resolved, emitted)
+	}
+	original, reproduced := fireOps(t, session.Bytes()), fireOps(t, replayed.Bytes())
+	if len(original) != 6 || !reflect.DeepEqual(original, reproduced) {
+		t.Errorf("Replay didn't reproduce the scheduling:\n%v\n%v", original, reproduced)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2017-2018 Ettore Di Giacinto
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+// OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+// DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package anagent
+
+import "time"
+
+// TimerRelativeTo is used to set a timer that fires offset after
+// the next scheduled fire of the base timer, and keeps following it
+// as the base timer is rescheduled. The timer is removed once it fires
+// after the base timer was removed.
+// It requires the base TimerID, the offset and the callback to be fired,
+// and returns false if the base timer does not exist.
+func (a *Anagent) TimerRelativeTo(base TimerID, offset time.Duration, handler Handler) (TimerID, bool) {
+	a.Lock()
+	b, ok := a.timers[base]
+	var at time.Time
+	if ok {
+		at = b.time
+	}
+	a.Unlock()
+	if !ok {
+		return "", false
+	}
+
+	handler = validateAndWrapHandler(handler)
+	id, _ := a.addTimer(TimerID(""), &Timer{handler: handler, time: at.Add(offset), after: offset, base: base})
+	return id, true
+}
+
+// rescheduleDependent schedules a relative timer that just fired
+// offset after the next fire of its base timer.
+// If the base timer has not been rescheduled yet, the timer waits for it.
+func (a *Anagent) rescheduleDependent(id TimerID, t *Timer, now time.Time) {
+	b, ok := a.timers[t.base]
+	if !ok {
+		delete(a.timers, id)
+		a.publish(TimerRemoved, id)
+		return
+	}
+
+	next := b.time.Add(t.after)
+	if next.After(now) {
+		t.time = next
+		return
+	}
+	t.waiting = true
+	t.time = next.Add(b.after)
+}
+
+// rescheduleDependents follows the base timer with the relative
+// timers that are waiting for it to be rescheduled.
+func (a *Anagent) rescheduleDependents(base TimerID, b *Timer) {
+	for _, t := range a.timers {
+		if t.base == base && t.waiting {
+			t.waiting = false
+			t.time = b.time.Add(t.after)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2017-2018 Ettore Di Giacinto
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+// OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+// DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package anagent
+
+import "time"
+
+// DeadLetterEvent is the event emitted with a DeadLetter when a listener
+// registered with OnRetry fails after all its retries.
+const DeadLetterEvent = "anagent.deadletter"
+
+// DeadLetter holds the event, its arguments and the last error
+// of a listener registered with OnRetry that exhausted its retries.
+type DeadLetter struct {
+	Event interface{}
+	Args  []interface{}
+	Err   error
+}
+
+// OnRetry Binds a callback to an event, like On, retrying it when it returns an error.
+// The listener is retried up to attempts times, waiting backoff between the retries
+// by setting timers on the agent, thus retries are fired by the loop.
+// When the retries are exhausted, DeadLetterEvent is emitted with a DeadLetter.
+func (a *Anagent) OnRetry(event interface{}, attempts int, backoff time.Duration, listener interface{}) *Anagent {
+	listener = validateAndWrapHandler(listener)
+	a.EventEmitter().On(event, func(args ...interface{}) {
+		a.countEvent(event, 0, 1)
+		a.retry(event, listener, a.transform(event, args), attempts, backoff)
+	})
+	return a
+}
+
+// retry invokes the listener, and schedules a new attempt if it fails.
+func (a *Anagent) retry(event, listener interface{}, args []interface{}, attempts int, backoff time.Duration) {
+	vals, err := a.InvokeIsolated(listener, args...)
+	if err == nil {
+		err = handlerError(vals)
+	}
+	if err == nil {
+		return
+	}
+
+	if attempts <= 0 {
+		a.emit(DeadLetterEvent, DeadLetter{Event: event, Args: args, Err: err})
+		return
+	}
+
+	a.Timer(TimerID(""), a.now().Add(backoff), backoff, false, func() {
+		a.retry(event, listener, args, attempts-1, backoff)
+	})
+}
@@ -0,0 +1,53 @@
+package anagent
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOnRetry(t *testing.T) {
+	agent := New()
+	calls := 0
+	agent.OnRetry("job", 3, 10*time.Millisecond, func(s string) error {
+		calls++
+		if calls < 3 {
+			return errors.New("not yet")
+		}
+		return nil
+	})
+	deadLetters := 0
+	agent.On(DeadLetterEvent, func(dl DeadLetter) { deadLetters++ })
+
+	agent.Emitter().Emit("job", "payload")
+	agent.SetRunDeadline(time.Now().Add(100 * time.Millisecond))
+	agent.Start()
+
+	if calls != 3 || deadLetters != 0 {
+		t.Errorf("Listener should succeed at the third attempt: %d calls, %d dead letters", calls, deadLetters)
+	}
+}
+
+func TestOnRetryDeadLetter(t *testing.T) {
+	agent := New()
+	calls := 0
+	agent.OnRetry("job", 2, 10*time.Millisecond, func() error {
+		calls++
+		return errors.New("boom")
+	})
+
+	var letter DeadLetter
+	agent.On(DeadLetterEvent, func(dl DeadLetter) { letter = dl })
+
+	agent.Emitter().Emit("job", "payload", 42)
+	agent.SetRunDeadline(time.Now().Add(100 * time.Millisecond))
+	agent.Start()
+
+	if calls != 3 {
+		t.Errorf("Listener should be retried twice: %d calls", calls)
+	}
+	if letter.Event != "job" || !reflect.DeepEqual(letter.Args, []interface{}{"payload", 42}) || letter.Err.Error() != "boom" {
+		t.Errorf("Unexpected dead letter: %v", letter)
+	}
+}
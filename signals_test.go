@@ -0,0 +1,87 @@
+package anagent
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// sendSignal sends the signal to the test process.
+func sendSignal(t *testing.T, sig os.Signal) {
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Signal(sig); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandleSignals(t *testing.T) {
+	agent := New()
+	ran := []string{}
+	agent.TimerSeconds(int64(60), true, func() {})
+	agent.OnStop(func() { ran = append(ran, "stop") })
+	agent.OnStart(func() { agent.Next(func() { ran = append(ran, "next") }) })
+	agent.OnStart(func() { agent.Pause() })
+	remove := agent.HandleSignals()
+	defer remove()
+
+	done := make(chan struct{})
+	go func() {
+		agent.Start()
+		close(done)
+	}()
+	for !agent.IsPaused() {
+		time.Sleep(time.Millisecond)
+	}
+
+	sendSignal(t, syscall.SIGTERM)
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Signal didn't stop the agent")
+	}
+	if len(ran) != 2 || ran[0] != "next" || ran[1] != "stop" {
+		t.Errorf("Expected the Next handlers to be drained before the OnStop hooks: %v", ran)
+	}
+}
+
+func TestHandleSignalsNoLeaks(t *testing.T) {
+	agent := New()
+	remove := agent.HandleSignals(syscall.SIGUSR1)
+	if err := agent.AssertNoLeaks(5 * time.Millisecond); err == nil {
+		t.Error("Expected the signal handler to be reported")
+	}
+	remove()
+	if err := agent.AssertNoLeaks(time.Second); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandleSignalsRemove(t *testing.T) {
+	agent := New()
+	agent.TimerSeconds(int64(60), true, func() {})
+	remove := agent.HandleSignals(syscall.SIGUSR1)
+	remove()
+	remove()
+	go agent.Start()
+	for !agent.IsStarted() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// keep the signal from terminating the test binary
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	defer signal.Stop(ch)
+	sendSignal(t, syscall.SIGUSR1)
+	<-ch
+	time.Sleep(50 * time.Millisecond)
+	if !agent.IsStarted() {
+		t.Error("Removed signal handler stopped the agent")
+	}
+	agent.StopAndWait()
+}
@@ -0,0 +1,84 @@
+// Copyright 2017-2018 Ettore Di Giacinto
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+// OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+// DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package anagent
+
+import "reflect"
+
+// flight is an execution of a single-flight handler in progress,
+// waiters counts the calls waiting for its results.
+type flight struct {
+	done    chan struct{}
+	out     []reflect.Value
+	waiters int
+}
+
+// SingleFlight wraps the handler so that only one execution per key runs
+// at a time: a call made while another one with the same key is in progress
+// waits for it and shares its results, instead of running the handler again.
+// The returned Handler has the same signature of the supplied one, so it can
+// be used with timers, events and middlewares alike.
+// It panics if the handler is not a callable func.
+func (a *Anagent) SingleFlight(key string, handler Handler) Handler {
+	fn := reflect.ValueOf(validateAndWrapHandler(handler))
+	t := fn.Type()
+
+	return reflect.MakeFunc(t, func(args []reflect.Value) []reflect.Value {
+		a.flightsAccess.Lock()
+		if f, ok := a.flights[key]; ok {
+			f.waiters++
+			a.flightsAccess.Unlock()
+			<-f.done
+			if f.out == nil {
+				return zeroValues(t)
+			}
+			return f.out
+		}
+		if a.flights == nil {
+			a.flights = make(map[string]*flight)
+		}
+		f := &flight{done: make(chan struct{})}
+		a.flights[key] = f
+		a.flightsAccess.Unlock()
+
+		defer func() {
+			a.flightsAccess.Lock()
+			delete(a.flights, key)
+			a.flightsAccess.Unlock()
+			close(f.done)
+		}()
+
+		if t.IsVariadic() {
+			f.out = fn.CallSlice(args)
+		} else {
+			f.out = fn.Call(args)
+		}
+		return f.out
+	}).Interface()
+}
+
+// zeroValues returns the zero values of the results of the func type.
+func zeroValues(t reflect.Type) []reflect.Value {
+	out := make([]reflect.Value, t.NumOut())
+	for i := range out {
+		out[i] = reflect.Zero(t.Out(i))
+	}
+	return out
+}
@@ -0,0 +1,67 @@
+package anagent
+
+import (
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitFlight waits until the execution of the single-flight handler
+// with the given key has the given number of waiters.
+func waitFlight(t *testing.T, agent *Anagent, key string, waiters int) {
+	for i := 0; ; i++ {
+		agent.flightsAccess.Lock()
+		f, ok := agent.flights[key]
+		reached := ok && f.waiters == waiters
+		agent.flightsAccess.Unlock()
+		if reached {
+			return
+		}
+		if i > 1000000 {
+			t.Fatalf("Flight %s never reached %d waiters", key, waiters)
+		}
+		runtime.Gosched()
+	}
+}
+
+func TestSingleFlight(t *testing.T) {
+	_, clock, agent := manualAgent()
+	agent.BusyLoop = true
+	var runs int32
+	release := make(chan struct{})
+	refresh := agent.SingleFlight("refresh", func() error {
+		atomic.AddInt32(&runs, 1)
+		<-release
+		return nil
+	})
+	agent.On("refresh", refresh)
+	agent.TimerSeconds(int64(1), false, refresh)
+
+	done := make(chan struct{})
+	go func() {
+		agent.EmitSync("refresh")
+		close(done)
+	}()
+	waitFlight(t, agent, "refresh", 0)
+
+	stepped := make(chan struct{})
+	clock.Add(time.Second)
+	go func() {
+		agent.Step()
+		close(stepped)
+	}()
+	waitFlight(t, agent, "refresh", 1)
+	close(release)
+	<-done
+	<-stepped
+
+	if n := atomic.LoadInt32(&runs); n != 1 {
+		t.Errorf("Expected concurrent triggers to coalesce in one execution, got %d", n)
+	}
+
+	agent.EmitSync("refresh")
+	if n := atomic.LoadInt32(&runs); n != 2 {
+		t.Errorf("Expected a new execution once the previous completed, got %d", n)
+	}
+}
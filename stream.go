@@ -0,0 +1,92 @@
+// Copyright 2017-2018 Ettore Di Giacinto
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+// OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+// DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package anagent
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// EventsBuffer is the size of the buffer of the channel returned by Events()
+const EventsBuffer = 64
+
+// AgentEventKind is the kind of an AgentEvent
+type AgentEventKind int
+
+const (
+	// TimerAdded is sent when a timer is set
+	TimerAdded AgentEventKind = iota
+	// TimerFired is sent after a timer handler is executed
+	TimerFired
+	// TimerRemoved is sent when a timer is removed from the loop
+	TimerRemoved
+	// AgentPaused is sent when the agent is paused
+	AgentPaused
+	// AgentResumed is sent when the agent is resumed
+	AgentResumed
+	// AgentStarted is sent when the loop is started with Start()
+	AgentStarted
+	// AgentStopped is sent when the loop started with Start() returns
+	AgentStopped
+)
+
+// AgentEvent represents a lifecycle event of the agent.
+// TimerID is set only for the timer related events.
+type AgentEvent struct {
+	Kind    AgentEventKind
+	TimerID TimerID
+	Time    time.Time
+}
+
+// Events returns a channel streaming the lifecycle events of the agent.
+// The channel is buffered, and events are dropped if the consumer
+// doesn't keep up, so the loop is never blocked.
+func (a *Anagent) Events() <-chan AgentEvent {
+	a.streamAccess.Lock()
+	defer a.streamAccess.Unlock()
+
+	if a.stream == nil {
+		a.stream = make(chan AgentEvent, EventsBuffer)
+	}
+	return a.stream
+}
+
+// DroppedEvents returns the number of events that were dropped
+// because the consumer of Events() was too slow.
+func (a *Anagent) DroppedEvents() uint64 {
+	return atomic.LoadUint64(&a.dropped)
+}
+
+// publish sends an event to the stream, if anyone is listening.
+func (a *Anagent) publish(kind AgentEventKind, id TimerID) {
+	a.streamAccess.Lock()
+	defer a.streamAccess.Unlock()
+
+	if a.stream == nil {
+		return
+	}
+
+	select {
+	case a.stream <- AgentEvent{Kind: kind, TimerID: id, Time: a.now()}:
+	default:
+		atomic.AddUint64(&a.dropped, 1)
+	}
+}
@@ -0,0 +1,60 @@
+package anagent
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEvents(t *testing.T) {
+	agent := New()
+	events := agent.Events()
+
+	removed := agent.AddTimerSeconds(int64(60), func() {})
+	agent.RemoveTimer(removed)
+	agent.Pause()
+	agent.Step()
+	agent.Resume()
+	fired := agent.Timer(TimerID("fired"), time.Now(), 0, false, func(a *Anagent) {
+		a.Stop()
+	})
+	agent.Start()
+
+	expected := []AgentEvent{
+		{Kind: TimerAdded, TimerID: removed},
+		{Kind: TimerRemoved, TimerID: removed},
+		{Kind: AgentPaused},
+		{Kind: AgentResumed},
+		{Kind: TimerAdded, TimerID: fired},
+		{Kind: AgentStarted},
+		{Kind: TimerFired, TimerID: fired},
+		{Kind: TimerRemoved, TimerID: fired},
+		{Kind: AgentStopped},
+	}
+
+	for i, e := range expected {
+		select {
+		case got := <-events:
+			got.Time = time.Time{}
+			if !reflect.DeepEqual(got, e) {
+				t.Errorf("Event %d: expected %v, got %v", i, e, got)
+			}
+		default:
+			t.Fatalf("Event %d: expected %v, got nothing", i, e)
+		}
+	}
+}
+
+func TestEventsDrop(t *testing.T) {
+	agent := New()
+	agent.Events()
+
+	for i := 0; i < EventsBuffer+5; i++ {
+		agent.Pause()
+		agent.Resume()
+	}
+
+	if agent.DroppedEvents() != EventsBuffer+10 {
+		t.Errorf("Unexpected number of dropped events: %d", agent.DroppedEvents())
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright 2017-2018 Ettore Di Giacinto
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+// OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+// DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package anagent
+
+import "sort"
+
+// subscription is a channel receiving the arguments of an event
+type subscription struct {
+	ch chan []interface{}
+}
+
+// Listener is the handle of a listener bound with OnPriority,
+// it can be used to unbind the listener with Off and to bind it
+// again with Rebind, keeping its original position.
+type Listener struct {
+	event    interface{}
+	priority int
+	seq      uint64
+	listener interface{}
+	once     bool
+}
+
+// Subscribe returns a channel receiving the arguments of each emission
+// of the event, along with a function that unsubscribes and closes the channel.
+// The channel is buffered with the given size, and emissions are dropped
+// if the consumer doesn't keep up, so emitters are never blocked.
+func (a *Anagent) Subscribe(event interface{}, buffer int) (<-chan []interface{}, func()) {
+	s := &subscription{ch: make(chan []interface{}, buffer)}
+
+	a.subsAccess.Lock()
+	defer a.subsAccess.Unlock()
+
+	a.bridge(event)
+	a.subs[event] = append(a.subs[event], s)
+
+	return s.ch, func() { a.unsubscribe(event, s) }
+}
+
+// OnPriority Binds a callback to an event, like On, with a priority.
+// The listeners bound with OnPriority are invoked one after another,
+// the ones with a lower priority first, and the ones sharing the same
+// priority in the order they were bound. Their order with respect to
+// the listeners bound with On is not defined.
+func (a *Anagent) OnPriority(event interface{}, priority int, listener interface{}) *Listener {
+	a.subsAccess.Lock()
+	a.listenerSeq++
+	l := &Listener{event: event, priority: priority, seq: a.listenerSeq, listener: validateAndWrapHandler(listener)}
+	a.subsAccess.Unlock()
+
+	a.Rebind(l)
+	return l
+}
+
+// Rebind binds again a listener unbound with Off, keeping
+// its priority and its position among the other listeners.
+func (a *Anagent) Rebind(l *Listener) {
+	a.subsAccess.Lock()
+	defer a.subsAccess.Unlock()
+
+	a.bridge(l.event)
+	listeners := a.prioritized[l.event]
+	for _, other := range listeners {
+		if other == l {
+			return
+		}
+	}
+
+	i := sort.Search(len(listeners), func(i int) bool {
+		o := listeners[i]
+		return o.priority > l.priority || (o.priority == l.priority && o.seq > l.seq)
+	})
+	listeners = append(listeners, nil)
+	copy(listeners[i+1:], listeners[i:])
+	listeners[i] = l
+	a.prioritized[l.event] = listeners
+}
+
+// Off unbinds a listener bound with OnPriority.
+// The other listeners keep their order.
+func (a *Anagent) Off(l *Listener) {
+	a.subsAccess.Lock()
+	defer a.subsAccess.Unlock()
+	a.off(l)
+}
+
+// off unbinds the listener, it must be called with subsAccess held.
+func (a *Anagent) off(l *Listener) {
+	listeners := a.prioritized[l.event]
+	for i := range listeners {
+		if listeners[i] == l {
+			a.prioritized[l.event] = append(listeners[:i:i], listeners[i+1:]...)
+			break
+		}
+	}
+	a.unbridge(l.event)
+}
+
+// bindTopic binds the listener like OnPriority, with priority 0,
+// and tracks it under the topic.
+func (a *Anagent) bindTopic(topic string, event, listener interface{}, once bool) {
+	a.subsAccess.Lock()
+	a.listenerSeq++
+	l := &Listener{event: event, seq: a.listenerSeq, listener: validateAndWrapHandler(listener), once: once}
+	if a.topics == nil {
+		a.topics = make(map[string][]*Listener)
+	}
+	a.topics[topic] = append(a.topics[topic], l)
+	a.subsAccess.Unlock()
+
+	a.Rebind(l)
+}
+
+// UnsubscribeTopic unbinds all the listeners bound with the topic,
+// and returns how many were bound.
+func (a *Anagent) UnsubscribeTopic(topic string) int {
+	a.subsAccess.Lock()
+	defer a.subsAccess.Unlock()
+	listeners := a.topics[topic]
+	delete(a.topics, topic)
+	for _, l := range listeners {
+		a.off(l)
+	}
+	return len(listeners)
+}
+
+// EmitSyncStopOnError emits the event with the arguments like EmitSync,
+// invoking the listeners one after another, and stops at the first one
+// returning an error, which is returned. The listeners bound with On run
+// in the order they were bound, the ones bound with OnPriority by priority,
+// at the position of the first of them. The listeners bound directly to
+// the Emitter receive the event as usual, and can't stop the others.
+func (a *Anagent) EmitSyncStopOnError(event interface{}, args ...interface{}) error {
+	a.countEvent(event, 1, 0)
+	if !a.handled(event) {
+		return nil
+	}
+	stop := &stopOnError{}
+	a.runStopOnError(stop, func() {
+		a.runSyncEmit(func() { a.EventEmitter().EmitSync(event, args...) })
+	})
+	return stop.err
+}
+
+// bridge binds to the emitter the listener dispatching the event
+// to the subscriptions and to the prioritized listeners.
+// It must be called with subsAccess held.
+func (a *Anagent) bridge(event interface{}) {
+	if a.bridges == nil {
+		a.subs = make(map[interface{}][]*subscription)
+		a.prioritized = make(map[interface{}][]*Listener)
+		a.bridges = make(map[interface{}]func(...interface{}))
+	}
+	if _, ok := a.bridges[event]; !ok {
+		bridge := func(args ...interface{}) { a.track(func() { a.dispatch(event, args) }) }
+		a.bridges[event] = bridge
+		a.EventEmitter().On(event, bridge)
+	}
+}
+
+// unbridge unbinds the bridge of the event from the emitter,
+// if there are no subscriptions nor prioritized listeners left.
+// It must be called with subsAccess held.
+func (a *Anagent) unbridge(event interface{}) {
+	if len(a.subs[event]) > 0 || len(a.prioritized[event]) > 0 {
+		return
+	}
+	if bridge, ok := a.bridges[event]; ok {
+		a.EventEmitter().RemoveListener(event, bridge)
+		delete(a.bridges, event)
+	}
+	delete(a.subs, event)
+	delete(a.prioritized, event)
+}
+
+// dispatch sends the arguments of an event to its subscriptions,
+// and invokes its prioritized listeners.
+func (a *Anagent) dispatch(event interface{}, args []interface{}) {
+	stop := a.stopState()
+	if stop != nil && stop.err != nil {
+		return
+	}
+	args = a.transform(event, args)
+	a.subsAccess.Lock()
+	for _, s := range a.subs[event] {
+		payload := make([]interface{}, len(args))
+		copy(payload, args)
+		select {
+		case s.ch <- payload:
+		default:
+		}
+	}
+	listeners := a.listenersOf(event)
+	a.subsAccess.Unlock()
+
+	for _, l := range listeners {
+		a.countEvent(event, 0, 1)
+		if err := a.invokeListener(event, l.listener, args); err != nil && stop != nil {
+			stop.err = err
+			return
+		}
+	}
+}
+
+// listenersOf returns a copy of the prioritized listeners of the event,
+// unbinding the ones to be invoked only once.
+// It must be called with subsAccess held.
+func (a *Anagent) listenersOf(event interface{}) []*Listener {
+	listeners := append([]*Listener{}, a.prioritized[event]...)
+	for _, l := range listeners {
+		if l.once {
+			a.off(l)
+		}
+	}
+	return listeners
+}
+
+// unsubscribe removes the subscription and closes its channel.
+func (a *Anagent) unsubscribe(event interface{}, s *subscription) {
+	a.subsAccess.Lock()
+	defer a.subsAccess.Unlock()
+
+	subs := a.subs[event]
+	for i := range subs {
+		if subs[i] == s {
+			a.subs[event] = append(subs[:i:i], subs[i+1:]...)
+			close(s.ch)
+			break
+		}
+	}
+	a.unbridge(event)
+}
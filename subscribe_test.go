@@ -0,0 +1,177 @@
+package anagent
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestSubscribe(t *testing.T) {
+	agent := New()
+	ch, unsubscribe := agent.Subscribe("metric", 2)
+	other, unsubscribeOther := agent.Subscribe("metric", 1)
+	defer unsubscribeOther()
+
+	agent.Emitter().Emit("metric", "cpu", 42)
+	agent.Emitter().Emit("metric", "mem", 7)
+	agent.Emitter().Emit("metric", "dropped", 0)
+
+	if got := <-ch; !reflect.DeepEqual(got, []interface{}{"cpu", 42}) {
+		t.Errorf("Unexpected payload: %v", got)
+	}
+	if got := <-ch; !reflect.DeepEqual(got, []interface{}{"mem", 7}) {
+		t.Errorf("Unexpected payload: %v", got)
+	}
+	if got := <-other; !reflect.DeepEqual(got, []interface{}{"cpu", 42}) {
+		t.Errorf("Unexpected payload: %v", got)
+	}
+
+	unsubscribe()
+	agent.Emitter().Emit("metric", "after", 1)
+	if _, ok := <-ch; ok {
+		t.Errorf("Channel should be closed after unsubscribing")
+	}
+	if got := <-other; !reflect.DeepEqual(got, []interface{}{"after", 1}) {
+		t.Errorf("Other subscriptions should keep receiving: %v", got)
+	}
+
+	unsubscribeOther()
+	if agent.Emitter().GetListenerCount("metric") != 0 {
+		t.Errorf("Bridge listener wasn't removed")
+	}
+}
+
+func TestOnPriority(t *testing.T) {
+	agent := New()
+	order := []string{}
+	listener := func(name string) func() {
+		return func() { order = append(order, name) }
+	}
+
+	agent.OnPriority("event", 3, listener("d"))
+	agent.OnPriority("event", 1, listener("a"))
+	b := agent.OnPriority("event", 2, listener("b"))
+	agent.OnPriority("event", 2, listener("c"))
+
+	agent.EmitSync("event")
+	if !reflect.DeepEqual(order, []string{"a", "b", "c", "d"}) {
+		t.Errorf("Listeners invoked in unexpected order: %v", order)
+	}
+
+	order = []string{}
+	agent.Off(b)
+	agent.OnPriority("event", 2, listener("e"))
+	agent.EmitSync("event")
+	if !reflect.DeepEqual(order, []string{"a", "c", "e", "d"}) {
+		t.Errorf("Removal disturbed the order of the other listeners: %v", order)
+	}
+
+	order = []string{}
+	agent.Rebind(b)
+	agent.Rebind(b)
+	agent.EmitSync("event")
+	if !reflect.DeepEqual(order, []string{"a", "b", "c", "e", "d"}) {
+		t.Errorf("Rebound listener didn't keep its position: %v", order)
+	}
+}
+
+func TestEmitSyncStopOnError(t *testing.T) {
+	agent := New()
+	ran := []string{}
+	agent.OnPriority("validate", 1, func(s string) error {
+		ran = append(ran, "first:"+s)
+		return nil
+	})
+	agent.OnPriority("validate", 2, func() error {
+		ran = append(ran, "second")
+		return errors.New("invalid")
+	})
+	agent.OnPriority("validate", 3, func() error {
+		ran = append(ran, "third")
+		return nil
+	})
+
+	err := agent.EmitSyncStopOnError("validate", "payload")
+	if err == nil || err.Error() != "invalid" {
+		t.Errorf("Expected the error of the second listener, got %v", err)
+	}
+	if !reflect.DeepEqual(ran, []string{"first:payload", "second"}) {
+		t.Errorf("Expected the chain to stop at the failing listener: %v", ran)
+	}
+	if err := agent.EmitSyncStopOnError("missing"); err != nil {
+		t.Errorf("Unexpected error for an event without listeners: %v", err)
+	}
+
+	ran = []string{}
+	agent.On("save", func(s string) error {
+		ran = append(ran, "on:"+s)
+		return nil
+	})
+	agent.OnPriority("save", 0, func() { ran = append(ran, "priority") })
+	agent.On("save", func() error {
+		ran = append(ran, "failing")
+		return errors.New("read-only")
+	})
+	agent.On("save", func() { ran = append(ran, "last") })
+	agent.Emitter().On("save", func(s string) { ran = append(ran, "raw:"+s) })
+	if err := agent.EmitSyncStopOnError("save", "payload"); err == nil || err.Error() != "read-only" {
+		t.Errorf("Expected the error of the On listener, got %v", err)
+	}
+	if !reflect.DeepEqual(ran, []string{"on:payload", "priority", "failing", "raw:payload"}) {
+		t.Errorf("Expected the On listeners to run in order and stop at the failing one: %v", ran)
+	}
+
+	// a nested EmitSync doesn't see the state of the outer emission
+	ran = []string{}
+	agent.On("outer", func(a *Anagent) error {
+		a.EmitSync("inner")
+		return errors.New("outer")
+	})
+	agent.On("inner", func() error {
+		ran = append(ran, "inner-first")
+		return errors.New("inner")
+	})
+	agent.On("inner", func() { ran = append(ran, "inner-second") })
+	if err := agent.EmitSyncStopOnError("outer"); err == nil || err.Error() != "outer" {
+		t.Errorf("Expected the error of the outer listener, got %v", err)
+	}
+	if !reflect.DeepEqual(ran, []string{"inner-first", "inner-second"}) {
+		t.Errorf("Nested EmitSync stopped at the failing listener: %v", ran)
+	}
+}
+
+func TestUnsubscribeTopic(t *testing.T) {
+	agent := New()
+	ran := []string{}
+	record := func(name string) func() {
+		return func() { ran = append(ran, name) }
+	}
+	agent.On("load", record("plugin-load"), "plugin")
+	agent.On("save", record("plugin-save"), "plugin")
+	agent.Once("load", record("plugin-once"), "plugin")
+	agent.On("load", record("core"))
+	agent.On("save", record("other"), "other")
+
+	if n := agent.UnsubscribeTopic("plugin"); n != 3 {
+		t.Errorf("Expected 3 listeners under the topic, got %d", n)
+	}
+	agent.EmitSync("load")
+	agent.EmitSync("save")
+	if !reflect.DeepEqual(ran, []string{"core", "other"}) {
+		t.Errorf("Expected only the listeners of the topic to be removed: %v", ran)
+	}
+	if n := agent.UnsubscribeTopic("plugin"); n != 0 {
+		t.Errorf("Expected no listeners left under the topic, got %d", n)
+	}
+}
+
+func TestOnceTopic(t *testing.T) {
+	agent := New()
+	fired := 0
+	agent.Once("event", func() { fired++ }, "topic")
+	agent.EmitSync("event")
+	agent.EmitSync("event")
+	if fired != 1 {
+		t.Errorf("Expected the listener to fire once, fired %d", fired)
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2017-2018 Ettore Di Giacinto
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+// OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+// DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package anagent
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TimelineWidth is the number of columns of the timeline written by WriteTimeline
+const TimelineWidth = 60
+
+// WriteTimeline writes an ASCII timeline of the fires of the timers in the
+// next window, one row per timer, labeled with the timer label or its ID.
+// Each of the TimelineWidth columns spans window/TimelineWidth, and
+// the columns where the timer is going to fire are marked with an 'x'.
+// Recurring timers are projected with their interval or cron expression.
+func (a *Anagent) WriteTimeline(w io.Writer, window time.Duration) error {
+	type row struct {
+		name  string
+		first time.Time
+		line  []byte
+	}
+
+	now := a.now()
+	end := now.Add(window)
+	a.Lock()
+	rows := []row{}
+	width := 0
+	for id, t := range a.timers {
+		r := row{name: string(id), first: t.time, line: []byte(strings.Repeat(".", TimelineWidth))}
+		if t.label != "" {
+			r.name = t.label
+		}
+		for f, ok := t.time, !t.paused; ok && f.Before(end); {
+			col := 0
+			if f.After(now) {
+				col = int(f.Sub(now) * TimelineWidth / window)
+			}
+			r.line[col] = 'x'
+			// Skip straight to the first fire in the next column
+			f, ok = t.seek(f, now.Add((time.Duration(col+1)*window+TimelineWidth-1)/TimelineWidth))
+		}
+		if len(r.name) > width {
+			width = len(r.name)
+		}
+		rows = append(rows, r)
+	}
+	a.Unlock()
+
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].first.Equal(rows[j].first) {
+			return rows[i].name < rows[j].name
+		}
+		return rows[i].first.Before(rows[j].first)
+	})
+	for _, r := range rows {
+		if _, err := fmt.Fprintf(w, "%-*s |%s|\n", width, r.name, r.line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seek returns the first projected fire of the timer at or after from,
+// starting from the fire f, without walking the fires in between.
+func (t *Timer) seek(f, from time.Time) (time.Time, bool) {
+	if !f.Before(from) {
+		return f, true
+	}
+	if t.cron != nil {
+		next := t.cron.next(from.Add(-time.Nanosecond))
+		return next, !next.IsZero()
+	}
+	if !t.recurring || t.after <= 0 {
+		return time.Time{}, false
+	}
+	n := (from.Sub(f) + t.after - 1) / t.after
+	return f.Add(n * t.after), true
+}
+
+// SimulatedFire is a fire projected by SimulateSchedule.
+type SimulatedFire struct {
+	TimerID TimerID
+	Time    time.Time
+}
+
+// SimulateSchedule projects the fires of the timers in the next d,
+// without invoking their handlers, ordered by time.
+// Recurring timers are projected with their interval or cron expression, regardless
+// of the duration of their handlers.
+func (a *Anagent) SimulateSchedule(d time.Duration) []SimulatedFire {
+	end := a.now().Add(d)
+	a.Lock()
+	fires := []SimulatedFire{}
+	for id, t := range a.timers {
+		if t.paused {
+			continue
+		}
+		for f, ok := t.time, true; ok && !f.After(end); f, ok = t.following(f) {
+			fires = append(fires, SimulatedFire{TimerID: id, Time: f})
+		}
+	}
+	a.Unlock()
+
+	sort.Slice(fires, func(i, j int) bool {
+		if fires[i].Time.Equal(fires[j].Time) {
+			return fires[i].TimerID < fires[j].TimerID
+		}
+		return fires[i].Time.Before(fires[j].Time)
+	})
+	return fires
+}
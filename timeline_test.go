@@ -0,0 +1,98 @@
+package anagent
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteTimeline(t *testing.T) {
+	_, _, agent := manualAgent()
+
+	poll := agent.TimerSeconds(int64(10), true, func() {})
+	agent.SetLabel(poll, "poll")
+	agent.TimerSeconds(int64(30), false, func() {})
+	agent.TimerSeconds(int64(120), false, func() {})
+
+	var out bytes.Buffer
+	if err := agent.WriteTimeline(&out, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimRight(out.String(), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected a row per timer, got:\n%s", out.String())
+	}
+
+	markers := func(line string) []int {
+		cols := []int{}
+		cells := line[strings.Index(line, "|")+1 : strings.LastIndex(line, "|")]
+		if len(cells) != TimelineWidth {
+			t.Errorf("Unexpected row width %d", len(cells))
+		}
+		for i, c := range cells {
+			if c == 'x' {
+				cols = append(cols, i)
+			}
+		}
+		return cols
+	}
+
+	if !strings.HasPrefix(lines[0], "poll ") || !reflect.DeepEqual(markers(lines[0]), []int{10, 20, 30, 40, 50}) {
+		t.Errorf("Unexpected row for the recurring timer: %q", lines[0])
+	}
+	if !reflect.DeepEqual(markers(lines[1]), []int{30}) {
+		t.Errorf("Unexpected row for the one-shot timer: %q", lines[1])
+	}
+	if len(markers(lines[2])) != 0 {
+		t.Errorf("Timer outside the window has markers: %q", lines[2])
+	}
+}
+
+func TestWriteTimelineDenseTimers(t *testing.T) {
+	_, clock, agent := manualAgent()
+
+	agent.Timer(TimerID("fast"), clock.Now(), time.Millisecond, true, func() {})
+	if _, err := agent.CronTimer(TimerID("daily"), "0 0 * * *", func() {}); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	done := make(chan error, 1)
+	go func() { done <- agent.WriteTimeline(&out, 365*24*time.Hour) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WriteTimeline walked every fire of the window")
+	}
+
+	full := strings.Repeat("x", TimelineWidth)
+	for _, line := range strings.Split(strings.TrimRight(out.String(), "\n"), "\n") {
+		if !strings.Contains(line, "|"+full+"|") {
+			t.Errorf("Expected every column marked, got %q", line)
+		}
+	}
+}
+
+func TestSimulateSchedule(t *testing.T) {
+	now, _, agent := manualAgent()
+	fired := false
+	agent.Timer(TimerID("poll"), now.Add(2*time.Second), 2*time.Second, true, func() { fired = true })
+	agent.Timer(TimerID("once"), now.Add(3*time.Second), 0, false, func() { fired = true })
+	agent.Timer(TimerID("later"), now.Add(time.Minute), 0, false, func() { fired = true })
+
+	at := func(id string, s int) SimulatedFire {
+		return SimulatedFire{TimerID: TimerID(id), Time: now.Add(time.Duration(s) * time.Second)}
+	}
+	expected := []SimulatedFire{at("poll", 2), at("once", 3), at("poll", 4), at("poll", 6)}
+	if fires := agent.SimulateSchedule(7 * time.Second); !reflect.DeepEqual(fires, expected) {
+		t.Errorf("Unexpected projected fires:\n%v\n%v", fires, expected)
+	}
+	if fired {
+		t.Error("SimulateSchedule invoked a handler")
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2017-2018 Ettore Di Giacinto
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+// OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+// DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package anagent
+
+import "time"
+
+// upcoming is a callback fired when timers enter its lead window,
+// warned holds the fire time each timer was already warned for.
+type upcoming struct {
+	lead   time.Duration
+	fn     func(id TimerID, when time.Time)
+	warned map[TimerID]time.Time
+}
+
+// OnUpcoming registers a callback that is fired once when a timer enters
+// the lead window before its scheduled time, with the TimerID and the
+// time the timer is going to fire. Recurring timers are warned before each fire.
+// The callback is run by the loop, during Step.
+func (a *Anagent) OnUpcoming(lead time.Duration, fn func(id TimerID, when time.Time)) {
+	a.Lock()
+	defer a.Unlock()
+	a.upcoming = append(a.upcoming, &upcoming{lead: lead, fn: fn, warned: make(map[TimerID]time.Time)})
+}
+
+// checkUpcoming fires the upcoming callbacks for the timers
+// that entered their lead window.
+func (a *Anagent) checkUpcoming() {
+	type warning struct {
+		fn   func(id TimerID, when time.Time)
+		id   TimerID
+		when time.Time
+	}
+
+	now := a.now()
+	warnings := []warning{}
+
+	a.Lock()
+	for _, u := range a.upcoming {
+		for id := range u.warned {
+			if _, ok := a.timers[id]; !ok {
+				delete(u.warned, id)
+			}
+		}
+		for id, t := range a.timers {
+			if u.warned[id].Equal(t.time) || t.time.Add(-u.lead).After(now) {
+				continue
+			}
+			u.warned[id] = t.time
+			warnings = append(warnings, warning{fn: u.fn, id: id, when: t.time})
+		}
+	}
+	a.Unlock()
+
+	for _, w := range warnings {
+		w.fn(w.id, w.when)
+	}
+}
+
+// nextWarning returns the earliest time an upcoming callback has to be fired.
+func (a *Anagent) nextWarning() (time.Time, bool) {
+	a.Lock()
+	defer a.Unlock()
+
+	var next time.Time
+	for _, u := range a.upcoming {
+		for id, t := range a.timers {
+			if u.warned[id].Equal(t.time) {
+				continue
+			}
+			if w := t.time.Add(-u.lead); next.IsZero() || w.Before(next) {
+				next = w
+			}
+		}
+	}
+	return next, !next.IsZero()
+}
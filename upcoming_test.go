@@ -0,0 +1,41 @@
+package anagent
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOnUpcoming(t *testing.T) {
+	start, clock, agent := manualAgent()
+	agent.BusyLoop = true
+	var warnedAt, firedAt, scheduled time.Time
+	warnings := 0
+
+	id := agent.Timer(TimerID("job"), start.Add(1100*time.Millisecond), 0, false, func() {
+		firedAt = clock.Now()
+	})
+	scheduled = agent.GetTimer(id).time
+
+	agent.OnUpcoming(time.Second, func(tid TimerID, when time.Time) {
+		if tid != id || !when.Equal(scheduled) {
+			t.Errorf("Unexpected warning: %s %v", tid, when)
+		}
+		warnedAt = clock.Now()
+		warnings++
+	})
+
+	for _, at := range []time.Duration{50, 100, 600, 1100} {
+		clock.Set(start.Add(at * time.Millisecond))
+		agent.Step()
+	}
+
+	if warnings != 1 {
+		t.Fatalf("Expected one warning, got %d", warnings)
+	}
+	if d := warnedAt.Sub(start); d != 100*time.Millisecond {
+		t.Errorf("Warning wasn't fired when the timer entered the lead window: %v", d)
+	}
+	if d := firedAt.Sub(warnedAt); d != time.Second {
+		t.Errorf("Warning wasn't fired a lead before the timer: %v", d)
+	}
+}
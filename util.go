@@ -24,6 +24,8 @@ import (
 	"crypto/md5"
 	"encoding/hex"
 	"math/rand"
+	"reflect"
+	"runtime"
 )
 
 // GetMD5Hash is a utility function to get MD5 digest
@@ -34,6 +36,14 @@ func GetMD5Hash(text string) string {
 	return hex.EncodeToString(hasher.Sum(nil))
 }
 
+// handlerName returns the function name of the handler.
+func handlerName(h Handler) string {
+	if f := runtime.FuncForPC(reflect.ValueOf(h).Pointer()); f != nil {
+		return f.Name()
+	}
+	return ""
+}
+
 func RandTimer(m map[TimerID]*Timer) (TimerID, *Timer) {
 	i := rand.Intn(len(m))
 	var tid TimerID
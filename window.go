@@ -0,0 +1,75 @@
+// Copyright 2017-2018 Ettore Di Giacinto
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+// OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+// DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package anagent
+
+import "time"
+
+// activeWindow is a daily window, expressed as offsets
+// from midnight, outside of which a timer doesn't fire.
+type activeWindow struct {
+	start, end time.Duration
+}
+
+// ActiveBetween restricts the fires of a timer to a daily window, from start
+// to end since midnight, in the location of the agent clock. Fires falling
+// outside the window are skipped: recurring timers are rescheduled as usual,
+// while one-shot timers are postponed to the next opening of the window.
+// A window whose end is before its start wraps midnight.
+// It requires a TimerID, and returns false if the timer does not exist.
+// Equal start and end remove the window.
+func (a *Anagent) ActiveBetween(id TimerID, start, end time.Duration) bool {
+	a.Lock()
+	defer a.Unlock()
+	t, ok := a.timers[id]
+	if !ok {
+		return false
+	}
+	if start == end {
+		t.window = nil
+	} else {
+		t.window = &activeWindow{start: start % (24 * time.Hour), end: end % (24 * time.Hour)}
+	}
+	return true
+}
+
+// midnight returns the start of the day of t.
+func midnight(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// contains reports whether t falls inside the window.
+func (w *activeWindow) contains(t time.Time) bool {
+	offset := t.Sub(midnight(t))
+	if w.start < w.end {
+		return offset >= w.start && offset < w.end
+	}
+	return offset >= w.start || offset < w.end
+}
+
+// next returns the next opening of the window after t.
+func (w *activeWindow) next(t time.Time) time.Time {
+	open := midnight(t).Add(w.start)
+	if !open.After(t) {
+		open = midnight(t.AddDate(0, 0, 1)).Add(w.start)
+	}
+	return open
+}
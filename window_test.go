@@ -0,0 +1,44 @@
+package anagent
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestActiveBetween(t *testing.T) {
+	start, clock, agent := manualAgent()
+	start = start.Truncate(24 * time.Hour)
+	clock.Set(start)
+
+	fires := []int{}
+	id := agent.Timer(TimerID(""), start.Add(time.Hour), time.Hour, true, func() {
+		fires = append(fires, clock.Now().Hour())
+	})
+	if !agent.ActiveBetween(id, 9*time.Hour, 12*time.Hour) {
+		t.Fatal("ActiveBetween didn't find the timer")
+	}
+	agent.Advance(24 * time.Hour)
+	if !reflect.DeepEqual(fires, []int{9, 10, 11}) {
+		t.Errorf("Fires outside the window: %v", fires)
+	}
+
+	fires = []int{}
+	agent.ActiveBetween(id, 22*time.Hour, 2*time.Hour)
+	agent.Advance(24 * time.Hour)
+	if !reflect.DeepEqual(fires, []int{1, 22, 23, 0}) {
+		t.Errorf("Fires outside the window wrapping midnight: %v", fires)
+	}
+
+	fired := time.Time{}
+	once := agent.Timer(TimerID(""), clock.Now().Add(time.Hour), time.Hour, false, func() { fired = clock.Now() })
+	agent.ActiveBetween(once, 9*time.Hour, 10*time.Hour)
+	agent.Advance(24 * time.Hour)
+	if fired.Hour() != 9 {
+		t.Errorf("Expected the one-shot timer to be postponed to the window, fired at %v", fired)
+	}
+
+	if agent.ActiveBetween(TimerID("missing"), time.Hour, 2*time.Hour) {
+		t.Error("ActiveBetween reported success for a missing timer")
+	}
+}